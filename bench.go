@@ -8,7 +8,17 @@ import (
 	"github.com/docker/docker/pkg/stringid"
 )
 
-func BenchmarkCreateEmptyLayer(b *testing.B) {
+func init() {
+	registerBenchmarks(
+		Benchmark{Name: "CreateEmptyLayer", F: benchmarkCreateEmptyLayer},
+		Benchmark{Name: "GetSingleBaseMount", F: benchmarkGetSingleBaseMount},
+		Benchmark{Name: "Get20BaseMount", F: benchmarkGet20BaseMount},
+		Benchmark{Name: "Get50BaseMount", F: benchmarkGet50BaseMount},
+		Benchmark{Name: "Get100BaseMount", F: benchmarkGet100BaseMount},
+	)
+}
+
+func benchmarkCreateEmptyLayer(b *testing.B) {
 	ls, err := getLayerStore()
 	if err != nil {
 		b.Fatal(err)
@@ -34,7 +44,7 @@ func BenchmarkCreateEmptyLayer(b *testing.B) {
 	}
 }
 
-func BenchmarkGetSingleBaseMount(b *testing.B) {
+func benchmarkGetSingleBaseMount(b *testing.B) {
 	b.StopTimer()
 	ls, err := getLayerStore()
 	if err != nil {
@@ -72,15 +82,15 @@ func BenchmarkGetSingleBaseMount(b *testing.B) {
 	}
 }
 
-func BenchmarkGet20BaseMount(b *testing.B) {
+func benchmarkGet20BaseMount(b *testing.B) {
 	benchmarkGetBaseMountWithDepth(b, 20)
 }
 
-func BenchmarkGet50BaseMount(b *testing.B) {
+func benchmarkGet50BaseMount(b *testing.B) {
 	benchmarkGetBaseMountWithDepth(b, 50)
 }
 
-func BenchmarkGet100BaseMount(b *testing.B) {
+func benchmarkGet100BaseMount(b *testing.B) {
 	benchmarkGetBaseMountWithDepth(b, 100)
 }
 
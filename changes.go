@@ -0,0 +1,189 @@
+package dsdbench
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/pkg/errors"
+)
+
+// changesFiles are the numbers of files in the lower layer of the
+// changes benchmarks
+var changesFiles = []struct {
+	name  string
+	files int
+	large bool
+}{
+	{"1k", 1000, false},
+	{"10k", 10000, false},
+	{"100k", 100000, false},
+	{"1M", 1000000, true},
+}
+
+// changesPercents are the percentages of lower files changed in the
+// read-write layer
+var changesPercents = []int{1, 10, 50}
+
+func init() {
+	for _, f := range changesFiles {
+		for _, percent := range changesPercents {
+			files, percent := f.files, percent
+			registerBenchmarks(Benchmark{
+				Name: fmt.Sprintf("Changes%sFiles%dPercent", f.name, percent),
+				F: func(b *testing.B) {
+					benchmarkChanges(b, files, percent)
+				},
+				ReportAllocs: true,
+				Large:        f.large,
+			})
+		}
+	}
+}
+
+// applyChanges changes the given percentage of the files of a layer
+// registered from a generated tar, each changed file is modified,
+// removed, has its mode changed or has a file added beside it. The
+// expected changes of the files are returned.
+func applyChanges(root string, files, percent int) (map[string]archive.ChangeType, error) {
+	r := rand.New(rand.NewSource(int64(files)))
+	changed := files * percent / 100
+	expected := make(map[string]archive.ChangeType, changed)
+	for j, i := range r.Perm(files)[:changed] {
+		name := generatedPath(i)
+		p := filepath.Join(root, name)
+		switch j % 4 {
+		case 0:
+			f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return nil, err
+			}
+			_, err = f.Write([]byte("changed"))
+			if err1 := f.Close(); err == nil {
+				err = err1
+			}
+			if err != nil {
+				return nil, err
+			}
+			expected["/"+name] = archive.ChangeModify
+		case 1:
+			if err := os.Remove(p); err != nil {
+				return nil, err
+			}
+			expected["/"+name] = archive.ChangeDelete
+		case 2:
+			if err := os.Chmod(p, 0600); err != nil {
+				return nil, err
+			}
+			expected["/"+name] = archive.ChangeModify
+		case 3:
+			if err := NewTestFile(name+".added", []byte("added"), 0644)(root); err != nil {
+				return nil, err
+			}
+			expected["/"+name+".added"] = archive.ChangeAdd
+		}
+	}
+	return expected, nil
+}
+
+// checkChanges checks that the changes are the expected file changes,
+// the only other changes allowed are modified parent directories.
+func checkChanges(changes []archive.Change, expected map[string]archive.ChangeType) error {
+	dirs := map[string]bool{}
+	for p := range expected {
+		for d := path.Dir(p); d != "/"; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	missing := make(map[string]archive.ChangeType, len(expected))
+	for p, kind := range expected {
+		missing[p] = kind
+	}
+	for _, c := range changes {
+		kind, ok := expected[c.Path]
+		switch {
+		case ok && c.Kind != kind:
+			return errors.Errorf("unexpected change %s, expected %s %s", c.String(), kind, c.Path)
+		case ok:
+			delete(missing, c.Path)
+		case !dirs[c.Path] || c.Kind != archive.ChangeModify:
+			return errors.Errorf("unexpected change %s", c.String())
+		}
+	}
+	for p, kind := range missing {
+		return errors.Errorf("missing change %s %s, %d of %d changes missing", kind, p, len(missing), len(expected))
+	}
+	return nil
+}
+
+// benchmarkChanges times getting the changes of a read-write layer in
+// which the given percentage of the files in the lower layer have been
+// changed. The changes are checked before timing and the number of
+// changes is checked in every iteration.
+func benchmarkChanges(b *testing.B, files, percent int) {
+	b.StopTimer()
+	ls, err := getLayerStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup(b, ls)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(GenerateTar(pw, TarOptions{
+			Seed:  1,
+			Files: files,
+		}))
+	}()
+	l, err := ls.Register(pr, "")
+	pr.Close()
+	if err != nil {
+		b.Fatalf("Failed to register layer: %+v", err)
+	}
+	defer ls.Release(l)
+
+	rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), l.ChainID(), nil)
+	if err != nil {
+		b.Fatalf("Failed to create rw layer: %v", err)
+	}
+	defer ls.ReleaseRWLayer(rw)
+	p, err := rw.Mount("")
+	if err != nil {
+		b.Fatalf("Mount error: %v", err)
+	}
+	expected, err := applyChanges(p, files, percent)
+	if err != nil {
+		rw.Unmount()
+		b.Fatalf("Failed to apply changes: %v", err)
+	}
+	if err := rw.Unmount(); err != nil {
+		b.Fatalf("Unmount error: %v", err)
+	}
+
+	changes, err := rw.Changes()
+	if err != nil {
+		b.Fatalf("Changes error: %+v", err)
+	}
+	if err := checkChanges(changes, expected); err != nil {
+		b.Fatalf("Changes check failure: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := rw.Changes()
+		if err != nil {
+			b.Fatalf("Changes error: %+v", err)
+		}
+		if len(c) != len(changes) {
+			b.Fatalf("unexpected %d changes, expected %d", len(c), len(changes))
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dmcgowan/dsdbench"
+	"github.com/dmcgowan/dsdbench/plugin"
+	"github.com/docker/docker/pkg/reexec"
+)
+
+const (
+	// exitOK is returned when all tests and benchmarks passed
+	exitOK = 0
+
+	// exitFailure is returned when any test or benchmark failed
+	exitFailure = 1
+
+	// exitUsage is returned when the command line is invalid
+	exitUsage = 2
+
+	// exitSetup is returned when the configured storage driver
+	// could not be initialized
+	exitSetup = 3
+)
+
+const usage = `Usage: dsdbench <command> [flags]
+
+Runs storage driver tests and benchmarks against a graph driver
+configuration.
+
+Commands:
+  test    run the storage driver tests
+  bench   run the storage driver benchmarks
+  report  run tests and benchmarks and print a summary
+  run     run layer spec files
+  crash   run crash consistency tests
+  plugin  serve a graph driver as a plugin
+
+Run 'dsdbench <command> -h' for the flags of a command.
+`
+
+type command struct {
+	name        string
+	description string
+	run         func(*options) int
+}
+
+var commands = []command{
+	{
+		name:        "test",
+		description: "Run the storage driver tests",
+		run:         runTestCommand,
+	},
+	{
+		name:        "bench",
+		description: "Run the storage driver benchmarks",
+		run:         runBenchCommand,
+	},
+	{
+		name:        "report",
+		description: "Run tests and benchmarks and print a summary",
+		run:         runReportCommand,
+	},
+	{
+		name:        "run",
+		description: "Run JSON or YAML layer spec files as tests",
+		run:         runSpecCommand,
+	},
+	{
+		name:        "crash",
+		description: "Kill a process using the layer store and check the store",
+		run:         runCrashCommand,
+	},
+	{
+		name:        "plugin",
+		description: "Serve a graph driver as a plugin on a unix socket",
+		run:         runPluginCommand,
+	},
+}
+
+// stringList is a flag value which may be set multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type options struct {
+	drivers       stringList
+	driverOptions stringList
+	proxyDrivers  stringList
+	plugins       stringList
+	root          string
+	keep          bool
+	forceUnmount  bool
+	verbose       bool
+
+	run        string
+	bench      string
+	benchTime  time.Duration
+	benchMem   bool
+	dropCaches bool
+	large      bool
+
+	stressDuration    time.Duration
+	stressConcurrency int
+
+	socket string
+
+	specs []string
+}
+
+// configs returns the storage configuration for each driver followed
+// by each proxied driver and each plugin. A driver or plugin is given
+// as the driver name or plugin path optionally followed by space
+// separated driver options, the common driver options are added to
+// each.
+func (o *options) configs() []dsdbench.Config {
+	var configs []dsdbench.Config
+	for _, proxy := range []bool{false, true} {
+		drivers := o.drivers
+		if proxy {
+			drivers = o.proxyDrivers
+		}
+		for _, d := range drivers {
+			fields := strings.Fields(d)
+			configs = append(configs, dsdbench.Config{
+				Driver:        fields[0],
+				DriverOptions: append(fields[1:], o.driverOptions...),
+				Root:          o.root,
+				Keep:          o.keep,
+				ForceUnmount:  o.forceUnmount,
+				DropCaches:    o.dropCaches,
+				Proxy:         proxy,
+
+				LargeBenchmarks: o.large,
+
+				StressDuration:    o.stressDuration,
+				StressConcurrency: o.stressConcurrency,
+			})
+		}
+	}
+	for _, p := range o.plugins {
+		fields := strings.Fields(p)
+		configs = append(configs, dsdbench.Config{
+			Plugin:        fields[0],
+			DriverOptions: append(fields[1:], o.driverOptions...),
+			Root:          o.root,
+			Keep:          o.keep,
+			ForceUnmount:  o.forceUnmount,
+			DropCaches:    o.dropCaches,
+
+			LargeBenchmarks: o.large,
+
+			StressDuration:    o.stressDuration,
+			StressConcurrency: o.stressConcurrency,
+		})
+	}
+	return configs
+}
+
+func main() {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(os.Stdout, usage)
+		return exitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		opts, err := parseOptions(cmd, args[1:])
+		if err == flag.ErrHelp {
+			return exitOK
+		} else if err != nil {
+			return exitUsage
+		}
+		return cmd.run(opts)
+	}
+
+	fmt.Fprintf(os.Stderr, "dsdbench: unknown command %q\n\n%s", args[0], usage)
+	return exitUsage
+}
+
+func parseOptions(cmd command, args []string) (*options, error) {
+	opts := &options{}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		args := "[flags]"
+		if cmd.name == "run" {
+			args = "[flags] spec..."
+		}
+		fmt.Fprintf(os.Stderr, "Usage: dsdbench %s %s\n\n%s\n\nFlags:\n", cmd.name, args, cmd.description)
+		fs.PrintDefaults()
+	}
+	if cmd.name == "plugin" {
+		fs.Var(&opts.drivers, "driver", "Graph driver with space separated options to serve")
+		fs.StringVar(&opts.socket, "socket", "", "Unix socket path to serve the plugin on")
+	} else {
+		fs.Var(&opts.drivers, "driver", "Graph driver with space separated options, may be given multiple times")
+		fs.Var(&opts.driverOptions, "o", "Graph driver option for all drivers, may be given multiple times")
+		fs.Var(&opts.plugins, "plugin", "Graph driver plugin socket or spec file with space separated options, may be given multiple times")
+		fs.Var(&opts.proxyDrivers, "proxy-driver", "Graph driver with space separated options run as a plugin served by this process, may be given multiple times")
+		fs.StringVar(&opts.root, "root", "", "Root directory for test layer stores")
+		fs.BoolVar(&opts.keep, "keep", false, "Keep test layer store directories")
+		fs.BoolVar(&opts.forceUnmount, "force-unmount", false, "Unmount mounts leaked by a test so following tests are not affected")
+		fs.BoolVar(&opts.verbose, "v", false, "Verbose output")
+	}
+	if cmd.name == "test" || cmd.name == "report" || cmd.name == "run" || cmd.name == "crash" {
+		fs.StringVar(&opts.run, "run", ".", "Run only tests matching the regular expression")
+	}
+	if cmd.name == "test" || cmd.name == "report" {
+		fs.DurationVar(&opts.stressDuration, "stress-duration", dsdbench.DefaultStressDuration, "Run the stress test for the duration, zero skips the stress test")
+		fs.IntVar(&opts.stressConcurrency, "stress-concurrency", dsdbench.DefaultStressConcurrency, "Number of goroutines running operations in the stress test, zero skips the stress test")
+	}
+	if cmd.name == "bench" || cmd.name == "report" {
+		fs.StringVar(&opts.bench, "bench", ".", "Run only benchmarks matching the regular expression")
+		fs.DurationVar(&opts.benchTime, "benchtime", time.Second, "Run each benchmark for the duration")
+		fs.BoolVar(&opts.benchMem, "benchmem", false, "Print memory allocations for benchmarks")
+		fs.BoolVar(&opts.dropCaches, "drop-caches", false, "Drop the system caches in cold cache benchmarks, requires root")
+		fs.BoolVar(&opts.large, "large", false, "Run the benchmarks which use 256MB or more of data or a million files")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if cmd.name == "run" {
+		if fs.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "dsdbench %s: no spec file given\n", cmd.name)
+			return nil, fmt.Errorf("no spec file")
+		}
+		opts.specs = fs.Args()
+	} else if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "dsdbench %s: unexpected arguments: %s\n", cmd.name, strings.Join(fs.Args(), " "))
+		return nil, fmt.Errorf("unexpected arguments")
+	}
+	for _, pattern := range []string{opts.run, opts.bench} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			fmt.Fprintf(os.Stderr, "dsdbench %s: invalid pattern: %v\n", cmd.name, err)
+			return nil, err
+		}
+	}
+
+	if opts.stressDuration < 0 || opts.stressConcurrency < 0 {
+		fmt.Fprintf(os.Stderr, "dsdbench %s: stress duration and concurrency must not be negative\n", cmd.name)
+		return nil, fmt.Errorf("invalid stress options")
+	}
+
+	if len(opts.drivers) == 0 && len(opts.proxyDrivers) == 0 && len(opts.plugins) == 0 {
+		if driver := os.Getenv("DOCKER_GRAPHDRIVER"); driver != "" {
+			opts.drivers = stringList{strings.TrimSpace(driver + " " + os.Getenv("DOCKER_GRAPHDRIVER_OPTIONS"))}
+		}
+	}
+	for _, d := range append(append(opts.drivers, opts.proxyDrivers...), opts.plugins...) {
+		if strings.TrimSpace(d) == "" {
+			fmt.Fprintf(os.Stderr, "dsdbench %s: empty graph driver\n", cmd.name)
+			return nil, fmt.Errorf("empty graph driver")
+		}
+	}
+	if len(opts.drivers) == 0 && len(opts.proxyDrivers) == 0 && len(opts.plugins) == 0 {
+		fmt.Fprintf(os.Stderr, "dsdbench %s: no graph driver given, use -driver or DOCKER_GRAPHDRIVER\n", cmd.name)
+		return nil, fmt.Errorf("no graph driver")
+	}
+	if cmd.name == "plugin" {
+		if len(opts.drivers) != 1 || opts.socket == "" {
+			fmt.Fprintf(os.Stderr, "dsdbench %s: a single graph driver and socket are required\n", cmd.name)
+			return nil, fmt.Errorf("invalid plugin options")
+		}
+	}
+
+	return opts, nil
+}
+
+// driverResults are the results of running against a single
+// storage configuration.
+type driverResults struct {
+	config  dsdbench.Config
+	err     error
+	results []result
+}
+
+func (d driverResults) label() string {
+	name := d.config.Driver
+	if d.config.Plugin != "" {
+		name = d.config.Plugin
+	} else if d.config.Proxy {
+		name = name + "(proxy)"
+	}
+	return strings.Join(append([]string{name}, d.config.DriverOptions...), " ")
+}
+
+// runDrivers runs f against each configured driver in turn. Drivers
+// which could not be initialized are returned with an error and no
+// results, an error is returned when the benchmarks could not be set
+// up.
+func runDrivers(opts *options, f func() []result) ([]driverResults, error) {
+	if opts.bench != "" {
+		if err := initBenchmarks(opts.benchTime); err != nil {
+			fmt.Fprintf(os.Stderr, "dsdbench: unable to set up benchmarks: %v\n", err)
+			return nil, err
+		}
+	}
+
+	configs := opts.configs()
+	all := make([]driverResults, len(configs))
+	for i, c := range configs {
+		all[i].config = c
+		if len(configs) > 1 {
+			fmt.Fprintf(os.Stdout, "=== DRIVER %s\n", all[i].label())
+		}
+
+		dsdbench.Configure(c)
+		if err := dsdbench.CheckConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "dsdbench: unable to use driver %s: %v\n", all[i].label(), err)
+			all[i].err = err
+			continue
+		}
+		all[i].results = f()
+		printSummary(os.Stdout, all[i].results)
+	}
+	return all, nil
+}
+
+// exitCode returns the failure exit code when any test or benchmark
+// failed, otherwise the setup exit code if any driver was unusable.
+func exitCode(all []driverResults) int {
+	code := exitOK
+	for _, d := range all {
+		if failed(d.results) {
+			return exitFailure
+		}
+		if d.err != nil {
+			code = exitSetup
+		}
+	}
+	return code
+}
+
+func runTestCommand(opts *options) int {
+	all, err := runDrivers(opts, func() []result {
+		return runTests(os.Stdout, dsdbench.Tests(), opts.run, opts.verbose)
+	})
+	if err != nil {
+		return exitSetup
+	}
+
+	printIssues(os.Stdout, all)
+	return exitCode(all)
+}
+
+func runBenchCommand(opts *options) int {
+	all, err := runDrivers(opts, func() []result {
+		return runBenchmarks(os.Stdout, dsdbench.Benchmarks(), opts.bench, opts.benchMem, opts.verbose)
+	})
+	if err != nil {
+		return exitSetup
+	}
+	return exitCode(all)
+}
+
+func runReportCommand(opts *options) int {
+	all, err := runDrivers(opts, func() []result {
+		results := runTests(os.Stdout, dsdbench.Tests(), opts.run, opts.verbose)
+		return append(results, runBenchmarks(os.Stdout, dsdbench.Benchmarks(), opts.bench, opts.benchMem, opts.verbose)...)
+	})
+	if err != nil {
+		return exitSetup
+	}
+
+	fmt.Fprintln(os.Stdout)
+	printReport(os.Stdout, all)
+	printIssues(os.Stdout, all)
+	return exitCode(all)
+}
+
+func runSpecCommand(opts *options) int {
+	tests, err := dsdbench.SpecTests(opts.specs...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dsdbench: %v\n", err)
+		return exitUsage
+	}
+
+	all, err := runDrivers(opts, func() []result {
+		return runTests(os.Stdout, tests, opts.run, opts.verbose)
+	})
+	if err != nil {
+		return exitSetup
+	}
+	return exitCode(all)
+}
+
+func runCrashCommand(opts *options) int {
+	all, err := runDrivers(opts, func() []result {
+		return runTests(os.Stdout, dsdbench.CrashTests(), opts.run, opts.verbose)
+	})
+	if err != nil {
+		return exitSetup
+	}
+	return exitCode(all)
+}
+
+func runPluginCommand(opts *options) int {
+	fields := strings.Fields(opts.drivers[0])
+	name := fields[0]
+	l, err := plugin.NewServer(name, fields[1:]...).Listen(opts.socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dsdbench: unable to serve plugin: %v\n", err)
+		return exitSetup
+	}
+	fmt.Fprintf(os.Stdout, "Serving %s graph driver plugin on %s\n", name, opts.socket)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	if err := l.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "dsdbench: failed to close plugin socket: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dmcgowan/dsdbench"
+)
+
+// printReport writes a table of the results with a row for each test
+// and benchmark and a column for each driver. Benchmarks show the time
+// per operation in place of the status and drivers which could not be
+// initialized show an error.
+func printReport(w io.Writer, all []driverResults) {
+	var names []string
+	cells := map[string][]string{}
+	for i, d := range all {
+		for _, r := range d.results {
+			row, ok := cells[r.name]
+			if !ok {
+				row = make([]string, len(all))
+				for j := range row {
+					if all[j].err != nil {
+						row[j] = "error"
+					} else {
+						row[j] = "-"
+					}
+				}
+				names = append(names, r.name)
+				cells[r.name] = row
+			}
+			row[i] = r.cell()
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	header := []string{"NAME"}
+	for _, d := range all {
+		header = append(header, d.label())
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, strings.Join(cells[name], "\t"))
+	}
+
+	tw.Flush()
+}
+
+func (r result) cell() string {
+	if r.bench != nil {
+		metrics := []string{fmt.Sprintf("%d ns/op", r.bench.NsPerOp())}
+		if r.bench.Bytes > 0 && r.bench.T > 0 {
+			mbPerSec := float64(r.bench.Bytes) * float64(r.bench.N) / 1e6 / r.bench.T.Seconds()
+			metrics = append(metrics, fmt.Sprintf("%.2f MB/s", mbPerSec))
+		}
+		if r.benchMem {
+			metrics = append(metrics, strings.Join(strings.Fields(r.bench.MemString()), " "))
+		}
+		var extra []string
+		for unit, v := range r.bench.Extra {
+			extra = append(extra, fmt.Sprintf("%.0f %s", v, unit))
+		}
+		sort.Strings(extra)
+		return strings.Join(append(metrics, extra...), " ")
+	}
+	return string(r.status)
+}
+
+// printIssues writes the known issues each driver configuration is
+// affected by, based on the tests which found the issues they check
+// for.
+func printIssues(w io.Writer, all []driverResults) {
+	var lines []string
+	for _, d := range all {
+		for _, r := range d.results {
+			if !r.issue || d.config.DriverName() == "" {
+				continue
+			}
+			affected := dsdbench.AffectedIssues(r.name, d.config.DriverName())
+			for _, i := range affected {
+				lines = append(lines, fmt.Sprintf("%s is affected by %s\n    %s", d.label(), i, i.URL))
+				if i.Kernel != "" {
+					lines = append(lines, "    "+i.Kernel)
+				}
+			}
+			if len(affected) > 0 {
+				continue
+			}
+			for _, i := range dsdbench.TestIssues(r.name) {
+				lines = append(lines, fmt.Sprintf("%s may be affected by an issue similar to %s\n    %s", d.label(), i, i.URL))
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nKnown issues:")
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dmcgowan/dsdbench"
+)
+
+type status string
+
+const (
+	statusPass status = "pass"
+	statusFail status = "fail"
+	statusSkip status = "skip"
+)
+
+// result is the outcome of a single test or benchmark
+type result struct {
+	name   string
+	status status
+
+	// issue is set for tests which found the known issues they
+	// check for
+	issue bool
+
+	// bench is set for benchmarks which completed
+	bench *testing.BenchmarkResult
+
+	// benchMem shows the memory allocations of the benchmark
+	benchMem bool
+}
+
+// initBenchmarks sets up the testing package flags used
+// by testing.Benchmark.
+func initBenchmarks(benchTime time.Duration) error {
+	testing.Init()
+	return flag.CommandLine.Parse([]string{"-test.benchtime=" + benchTime.String()})
+}
+
+// testRunner implements dsdbench.T to run a single test outside of
+// "go test". FailNow and SkipNow exit the goroutine running the test.
+type testRunner struct {
+	name string
+
+	mu      sync.Mutex
+	output  bytes.Buffer
+	failed  bool
+	skipped bool
+	issue   bool
+}
+
+func (t *testRunner) log(s string) {
+	_, file, line, ok := runtime.Caller(2)
+	if ok {
+		file = filepath.Base(file)
+	} else {
+		file = "???"
+		line = 1
+	}
+	s = strings.Replace(strings.TrimSuffix(s, "\n"), "\n", "\n        ", -1)
+
+	t.mu.Lock()
+	fmt.Fprintf(&t.output, "    %s:%d: %s\n", file, line, s)
+	t.mu.Unlock()
+}
+
+func (t *testRunner) Error(args ...interface{}) {
+	t.log(fmt.Sprintln(args...))
+	t.Fail()
+}
+
+func (t *testRunner) Errorf(format string, args ...interface{}) {
+	t.log(fmt.Sprintf(format, args...))
+	t.Fail()
+}
+
+func (t *testRunner) Fail() {
+	t.mu.Lock()
+	t.failed = true
+	t.mu.Unlock()
+}
+
+func (t *testRunner) FailNow() {
+	t.Fail()
+	runtime.Goexit()
+}
+
+func (t *testRunner) Failed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed
+}
+
+func (t *testRunner) Fatal(args ...interface{}) {
+	t.log(fmt.Sprintln(args...))
+	t.FailNow()
+}
+
+func (t *testRunner) Fatalf(format string, args ...interface{}) {
+	t.log(fmt.Sprintf(format, args...))
+	t.FailNow()
+}
+
+func (t *testRunner) Log(args ...interface{}) {
+	t.log(fmt.Sprintln(args...))
+}
+
+func (t *testRunner) Logf(format string, args ...interface{}) {
+	t.log(fmt.Sprintf(format, args...))
+}
+
+func (t *testRunner) Name() string {
+	return t.name
+}
+
+func (t *testRunner) Skip(args ...interface{}) {
+	t.log(fmt.Sprintln(args...))
+	t.SkipNow()
+}
+
+func (t *testRunner) SkipNow() {
+	t.mu.Lock()
+	t.skipped = true
+	t.mu.Unlock()
+	runtime.Goexit()
+}
+
+func (t *testRunner) Skipf(format string, args ...interface{}) {
+	t.log(fmt.Sprintf(format, args...))
+	t.SkipNow()
+}
+
+func (t *testRunner) Skipped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.skipped
+}
+
+func (t *testRunner) IssueFound() {
+	t.mu.Lock()
+	t.issue = true
+	t.mu.Unlock()
+}
+
+func (t *testRunner) status() status {
+	switch {
+	case t.Failed():
+		return statusFail
+	case t.Skipped():
+		return statusSkip
+	default:
+		return statusPass
+	}
+}
+
+// runTest runs a single test and writes its output in the same
+// format as "go test".
+func runTest(w io.Writer, test dsdbench.Test, verbose bool) result {
+	if verbose {
+		fmt.Fprintf(w, "=== RUN   %s\n", test.Name)
+	}
+
+	t := &testRunner{name: test.Name}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				t.mu.Lock()
+				fmt.Fprintf(&t.output, "    panic: %v\n%s", r, debug.Stack())
+				t.mu.Unlock()
+				t.Fail()
+			}
+		}()
+		test.F(t)
+	}()
+	<-done
+
+	st := t.status()
+	if st == statusFail || verbose {
+		fmt.Fprintf(w, "--- %s: %s (%.2fs)\n", strings.ToUpper(string(st)), test.Name, time.Since(start).Seconds())
+		w.Write(t.output.Bytes())
+	}
+
+	return result{
+		name:   test.Name,
+		status: st,
+		issue:  t.issue && st == statusFail,
+	}
+}
+
+// runTests runs all tests with names matching the pattern
+func runTests(w io.Writer, tests []dsdbench.Test, pattern string, verbose bool) []result {
+	var results []result
+	re := regexp.MustCompile(pattern)
+	for _, test := range tests {
+		if !re.MatchString(test.Name) {
+			continue
+		}
+		results = append(results, runTest(w, test, verbose))
+	}
+	return results
+}
+
+// runBenchmark runs a single benchmark, the output of the benchmark
+// is not available when run outside of "go test". Allocations are
+// reported when requested for all benchmarks or by the benchmark.
+func runBenchmark(bench dsdbench.Benchmark, benchMem bool) result {
+	benchMem = benchMem || bench.ReportAllocs
+	st := statusPass
+	br := testing.Benchmark(func(b *testing.B) {
+		defer func() {
+			switch {
+			case b.Failed():
+				st = statusFail
+			case b.Skipped() && st == statusPass:
+				st = statusSkip
+			}
+		}()
+		bench.F(b)
+	})
+
+	r := result{
+		name:     bench.Name,
+		status:   st,
+		benchMem: benchMem,
+	}
+	if st == statusPass {
+		r.bench = &br
+	}
+	return r
+}
+
+// runBenchmarks runs all benchmarks with names matching the pattern
+func runBenchmarks(w io.Writer, benchmarks []dsdbench.Benchmark, pattern string, benchMem, verbose bool) []result {
+	var results []result
+	re := regexp.MustCompile(pattern)
+	for _, bench := range benchmarks {
+		if !re.MatchString(bench.Name) {
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(w, "=== BENCH %s\n", bench.Name)
+		}
+		r := runBenchmark(bench, benchMem)
+		if r.bench != nil && r.benchMem {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", bench.Name, r.bench.String(), r.bench.MemString())
+		} else if r.bench != nil {
+			fmt.Fprintf(w, "%s\t%s\n", bench.Name, r.bench.String())
+		} else {
+			fmt.Fprintf(w, "--- %s: %s\n", strings.ToUpper(string(r.status)), bench.Name)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func failed(results []result) bool {
+	for _, r := range results {
+		if r.status == statusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func printSummary(w io.Writer, results []result) {
+	if failed(results) {
+		fmt.Fprintln(w, "FAIL")
+	} else {
+		fmt.Fprintln(w, "PASS")
+	}
+}
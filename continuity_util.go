@@ -3,6 +3,8 @@ package dsdbench
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/stevvooe/continuity"
 )
@@ -13,12 +15,25 @@ type resourceUpdate struct {
 }
 
 func (u resourceUpdate) String() string {
-	return fmt.Sprintf("%s(mode: %o, uid: %s, gid: %s) -> %s(mode: %o, uid: %s, gid: %s)",
-		u.Original.Path(), u.Original.Mode(), u.Original.UID(), u.Original.GID(),
-		u.Updated.Path(), u.Updated.Mode(), u.Updated.UID(), u.Updated.GID(),
+	return fmt.Sprintf("%s(mode: %o, uid: %s, gid: %s%s) -> %s(mode: %o, uid: %s, gid: %s%s)",
+		u.Original.Path(), u.Original.Mode(), u.Original.UID(), u.Original.GID(), xattrString(u.Original),
+		u.Updated.Path(), u.Updated.Mode(), u.Updated.UID(), u.Updated.GID(), xattrString(u.Updated),
 	)
 }
 
+func xattrString(r continuity.Resource) string {
+	x := xattrs(r)
+	if len(x) == 0 {
+		return ""
+	}
+	attrs := make([]string, 0, len(x))
+	for attr, value := range x {
+		attrs = append(attrs, fmt.Sprintf("%s=%q", attr, value))
+	}
+	sort.Strings(attrs)
+	return ", xattrs: " + strings.Join(attrs, " ")
+}
+
 type resourceListDifference struct {
 	Additions []continuity.Resource
 	Deletions []continuity.Resource
@@ -100,12 +115,48 @@ func compareResource(r1, r2 continuity.Resource) bool {
 		return false
 	}
 
-	// TODO(dmcgowan): Check if is XAttrer
+	if !compareXAttrs(r1, r2) {
+		return false
+	}
 
 	return compareResourceTypes(r1, r2)
 
 }
 
+// ignoredXAttrs are not compared since they depend on the mount
+// rather than the content, such as the SELinux label.
+var ignoredXAttrs = map[string]bool{
+	"security.selinux": true,
+}
+
+func xattrs(r continuity.Resource) map[string][]byte {
+	x, ok := r.(continuity.XAttrer)
+	if !ok {
+		return nil
+	}
+	xattrs := map[string][]byte{}
+	for attr, value := range x.XAttrs() {
+		if !ignoredXAttrs[attr] {
+			xattrs[attr] = value
+		}
+	}
+	return xattrs
+}
+
+func compareXAttrs(r1, r2 continuity.Resource) bool {
+	x1 := xattrs(r1)
+	x2 := xattrs(r2)
+	if len(x1) != len(x2) {
+		return false
+	}
+	for attr, value := range x1 {
+		if v, ok := x2[attr]; !ok || !bytes.Equal(v, value) {
+			return false
+		}
+	}
+	return true
+}
+
 func compareResourceTypes(r1, r2 continuity.Resource) bool {
 	switch t1 := r1.(type) {
 	case continuity.RegularFile:
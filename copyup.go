@@ -0,0 +1,205 @@
+package dsdbench
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/pkg/errors"
+)
+
+// copyUpSizes are the sizes of the lower file in the copy up benchmarks
+var copyUpSizes = []struct {
+	name  string
+	size  int64
+	large bool
+}{
+	{"4KB", 4 << 10, false},
+	{"64KB", 64 << 10, false},
+	{"1MB", 1 << 20, false},
+	{"16MB", 16 << 20, false},
+	{"256MB", 256 << 20, true},
+	{"1GB", 1 << 30, true},
+}
+
+// copyUpOp is a first change made to a lower file, causing a copy up
+// of the file on copy up drivers
+type copyUpOp struct {
+	name   string
+	change func(path string, size int64) error
+
+	// size and mode are the expected size and mode after the change
+	// to a file with the given size and mode 0644
+	size func(size int64) int64
+	mode os.FileMode
+}
+
+func sameSize(size int64) int64 { return size }
+
+var copyUpOps = []copyUpOp{
+	{"Append", copyUpAppend, func(size int64) int64 { return size + 1 }, 0644},
+	{"Overwrite", copyUpOverwrite, sameSize, 0644},
+	{"Truncate", copyUpTruncate, func(size int64) int64 { return size / 2 }, 0644},
+	{"Chmod", copyUpChmod, sameSize, 0600},
+}
+
+func init() {
+	for _, op := range copyUpOps {
+		for _, s := range copyUpSizes {
+			op, s := op, s
+			registerBenchmarks(Benchmark{
+				Name: fmt.Sprintf("CopyUp%s%s", op.name, s.name),
+				F: func(b *testing.B) {
+					benchmarkCopyUp(b, s.size, op)
+				},
+				Large: s.large,
+			})
+		}
+	}
+}
+
+// NewSizedFile returns a file applier which creates a file as the
+// provided name with the given size and permission. The content is
+// written in chunks so large files are not held in memory and is not
+// sparse.
+func NewSizedFile(name string, size int64, perm os.FileMode) ApplyFile {
+	return func(root string) error {
+		fullPath := filepath.Join(root, name)
+		f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		chunk := bytes.Repeat([]byte("dsdbench"), 1<<17)
+		for size > 0 {
+			n := int64(len(chunk))
+			if size < n {
+				n = size
+			}
+			if _, err := f.Write(chunk[:n]); err != nil {
+				return err
+			}
+			size -= n
+		}
+
+		if err := f.Chmod(perm); err != nil {
+			return err
+		}
+
+		return f.Close()
+	}
+}
+
+// copyUpAppend appends a byte to the file and syncs it
+func copyUpAppend(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyUpOverwrite overwrites the first byte of the file and syncs it
+func copyUpOverwrite(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{'\n'}, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyUpTruncate truncates the file to half its size
+func copyUpTruncate(path string, size int64) error {
+	return os.Truncate(path, size/2)
+}
+
+// copyUpChmod only changes the mode of the file
+func copyUpChmod(path string, size int64) error {
+	return os.Chmod(path, 0600)
+}
+
+// checkCopyUp checks the size and mode of the file after the change,
+// since a driver which loses the change may otherwise look fast
+func checkCopyUp(path string, size int64, op copyUpOp) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if expected := op.size(size); fi.Size() != expected {
+		return errors.Errorf("unexpected size %d, expected %d", fi.Size(), expected)
+	}
+	if fi.Mode().Perm() != op.mode {
+		return errors.Errorf("unexpected mode %s, expected %s", fi.Mode().Perm(), op.mode)
+	}
+	return nil
+}
+
+// benchmarkCopyUp times the first change to a file of the given size
+// in a lower layer, each iteration changes the file in a new read-write
+// layer. Writes are synced so the cost of drivers which copy blocks on
+// write back is included.
+func benchmarkCopyUp(b *testing.B, size int64, op copyUpOp) {
+	b.StopTimer()
+	ls, err := getLayerStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup(b, ls)
+
+	l, err := CreateLayerChain(ls, InitWithFiles(
+		CreateDirectory("/data", 0755),
+		NewSizedFile("/data/file", size, 0644),
+	))
+	if err != nil {
+		b.Fatalf("Failed to create layer chain: %+v", err)
+	}
+	defer ls.Release(l)
+
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), l.ChainID(), nil)
+		if err != nil {
+			b.Fatalf("Failed to create rw layer: %v", err)
+		}
+		p, err := rw.Mount("")
+		if err != nil {
+			b.Fatalf("Mount error: %v", err)
+		}
+		path := filepath.Join(p, "data", "file")
+
+		b.StartTimer()
+		err = op.change(path, size)
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("Copy up error: %v", err)
+		}
+		if err := checkCopyUp(path, size, op); err != nil {
+			b.Fatalf("Copy up check failure: %v", err)
+		}
+
+		if err := rw.Unmount(); err != nil {
+			b.Fatalf("Unmount error: %v", err)
+		}
+		if _, err := ls.ReleaseRWLayer(rw); err != nil {
+			b.Fatalf("Failed to release rw layer: %v", err)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package dsdbench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	crashProcess   = "dsdbench-crash"
+	crashConfigEnv = "DSDBENCH_CRASH_CONFIG"
+
+	// crashIterations is the number of times the crash process runs
+	// each operation
+	crashIterations = 3
+)
+
+// crashOps are the layer store operations run by the crash process in
+// each iteration. Each iteration registers a layer on the base layer
+// and creates a read-write layer on it, then releases the read-write
+// layer and layer from the previous iteration, deleting them.
+var crashOps = []string{"register", "create-rw", "release-rw", "release"}
+
+func init() {
+	reexec.Register(crashProcess, runCrashProcess)
+
+	registerCrashTests(
+		Test{Name: "CrashRegister", F: crashTest("register")},
+		Test{Name: "CrashCreateRWLayer", F: crashTest("create-rw")},
+		Test{Name: "CrashReleaseRWLayer", F: crashTest("release-rw")},
+		Test{Name: "CrashRelease", F: crashTest("release")},
+		Test{Name: "CrashRandom", F: crashTest("")},
+	)
+}
+
+// crashTar returns a layer tar with enough content for registering
+// the layer to take a measurable amount of time
+func crashTar(i int) ([]byte, error) {
+	files := []ApplyFile{
+		CreateDirectory("/usr/lib", 0755),
+	}
+	for j := 0; j < 32; j++ {
+		content := bytes.Repeat([]byte(fmt.Sprintf("layer %d file %d\n", i, j)), 4096)
+		files = append(files, NewTestFile(fmt.Sprintf("/usr/lib/lib%d.so", j), content, 0644))
+	}
+	return TarFromFiles(files...)
+}
+
+// runCrashProcess runs the crash operations on the layer store at the
+// root given as the first argument, on top of the base layer given as
+// the second argument. Each operation is written to file descriptor 3
+// before it is started so the test can kill the process during the
+// operation.
+func runCrashProcess() {
+	w := os.NewFile(3, "steps")
+	if err := crashOperations(w); err != nil {
+		fmt.Fprintf(w, "error %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(w, "done")
+	os.Exit(0)
+}
+
+func crashOperations(w *os.File) error {
+	if len(os.Args) != 3 {
+		return errors.New("missing root and base layer")
+	}
+	var c Config
+	if err := json.Unmarshal([]byte(os.Getenv(crashConfigEnv)), &c); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	Configure(c)
+
+	ls, err := openLayerStore(os.Args[1])
+	if err != nil {
+		return err
+	}
+	base := layer.ChainID(os.Args[2])
+
+	var (
+		layers []layer.Layer
+		mounts []layer.RWLayer
+	)
+	for i := 0; i < crashIterations; i++ {
+		tar, err := crashTar(i)
+		if err != nil {
+			return err
+		}
+		for _, op := range crashOps {
+			fmt.Fprintf(w, "start %s %d\n", op, i)
+
+			switch op {
+			case "register":
+				l, err := ls.Register(bytes.NewReader(tar), base)
+				if err != nil {
+					return errors.Wrap(err, "failed to register")
+				}
+				layers = append(layers, l)
+			case "create-rw":
+				rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), layers[i].ChainID(), &layer.CreateRWLayerOpts{
+					InitFunc: layer.MountInit(InitWithFiles(
+						CreateDirectory("/etc", 0755),
+						NewTestFile("/etc/hostname", []byte(fmt.Sprintf("container%d", i)), 0644),
+					)),
+				})
+				if err != nil {
+					return errors.Wrap(err, "failed to create rw layer")
+				}
+				mounts = append(mounts, rw)
+			case "release-rw":
+				if i > 0 {
+					if _, err := ls.ReleaseRWLayer(mounts[i-1]); err != nil {
+						return errors.Wrap(err, "failed to release rw layer")
+					}
+				}
+			case "release":
+				if i > 0 {
+					if _, err := ls.Release(layers[i-1]); err != nil {
+						return errors.Wrap(err, "failed to release layer")
+					}
+				}
+			}
+		}
+	}
+
+	return ls.close()
+}
+
+// crashPoint is the operation during which the crash process is
+// killed, the process is killed after the delay once the operation
+// has started.
+type crashPoint struct {
+	op        string
+	iteration int
+	delay     time.Duration
+}
+
+func (p crashPoint) String() string {
+	return fmt.Sprintf("%s %d after %s", p.op, p.iteration, p.delay)
+}
+
+// randomCrashPoint returns a random operation and delay
+func randomCrashPoint() crashPoint {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return crashPoint{
+		op:        crashOps[r.Intn(len(crashOps))],
+		iteration: 1 + r.Intn(crashIterations-1),
+		delay:     time.Duration(r.Int63n(int64(20 * time.Millisecond))),
+	}
+}
+
+// crash runs the crash process on the layer store at root and kills
+// it at the crash point. Returns whether the process was killed before
+// it completed the operation.
+func crash(root string, base layer.ChainID, point crashPoint) (bool, error) {
+	c, err := json.Marshal(config)
+	if err != nil {
+		return false, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	cmd := reexec.Command(crashProcess, root, string(base))
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	cmd.Env = append(os.Environ(), crashConfigEnv+"="+string(c))
+	cmd.ExtraFiles = []*os.File{w}
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return false, errors.Wrap(err, "failed to start crash process")
+	}
+	w.Close()
+
+	var (
+		killed bool
+		during bool
+		failed string
+	)
+	start := fmt.Sprintf("start %s %d", point.op, point.iteration)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == start && !killed {
+			time.Sleep(point.delay)
+			cmd.Process.Kill()
+			killed = true
+			during = true
+			continue
+		}
+		if killed {
+			// The operation completed before the process was killed
+			during = false
+		}
+		if strings.HasPrefix(line, "error ") {
+			failed = strings.TrimPrefix(line, "error ")
+		}
+	}
+
+	if err := cmd.Wait(); err != nil && !killed {
+		if failed == "" {
+			failed = strings.TrimSpace(stderr.String())
+		}
+		return false, errors.Errorf("crash process failed: %s", failed)
+	}
+
+	return during, nil
+}
+
+// idPattern matches the names of driver directories and files
+var idPattern = regexp.MustCompile(`^[0-9a-f]{64}(-init)?$`)
+
+// orphanedIDs returns the paths in the root named after driver IDs which
+// are not used by any layer or read-write layer. The layer metadata
+// directory is not checked.
+func orphanedIDs(root string, used map[string]bool) ([]string, error) {
+	var orphans []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "layer" {
+			return filepath.SkipDir
+		}
+		if idPattern.MatchString(fi.Name()) {
+			if !used[fi.Name()] {
+				orphans = append(orphans, rel)
+			}
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Driver IDs are at most a few directories below the root
+		if fi.IsDir() && strings.Count(rel, string(filepath.Separator)) >= 2 {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(orphans)
+	return orphans, err
+}
+
+// checkCrashedStore reopens the layer store at root after a crash and
+// checks that every layer and read-write layer in the store is intact
+// and that the driver has no orphaned layers. The layers and read-write
+// layers are then removed.
+func checkCrashedStore(t T, root string, base layer.ChainID) {
+	if err := unmountAll(root); err != nil {
+		t.Fatalf("Failed to unmount after crash: %+v", err)
+	}
+
+	ls, err := openLayerStore(root)
+	if err != nil {
+		t.Fatalf("Failed to load layer store after crash: %+v", err)
+	}
+	defer cleanup(t, ls)
+
+	ms, err := layer.NewFSMetadataStore(filepath.Join(root, "layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, mountNames, err := ms.List()
+	if err != nil {
+		t.Fatalf("Failed to list layer metadata: %+v", err)
+	}
+
+	layers := ls.Map()
+	if _, ok := layers[base]; !ok {
+		t.Errorf("base layer %s missing after crash", base)
+	}
+
+	used := map[string]bool{}
+	for _, id := range ids {
+		if _, ok := layers[id]; !ok {
+			t.Errorf("layer %s not loaded after crash", id)
+		}
+		if cacheID, err := ms.GetCacheID(id); err == nil {
+			used[cacheID] = true
+		}
+	}
+
+	for chainID := range layers {
+		l, err := ls.Get(chainID)
+		if err != nil {
+			t.Errorf("Failed to get layer %s after crash: %+v", chainID, err)
+			continue
+		}
+		defer func(l layer.Layer) {
+			if _, err := ls.Release(l); err != nil {
+				t.Errorf("Failed to release layer %s after crash: %+v", l.ChainID(), err)
+			}
+		}(l)
+
+		ts, err := l.TarStream()
+		if err != nil {
+			t.Errorf("Failed to get tar stream of layer %s after crash: %+v", chainID, err)
+			continue
+		}
+		dgst, err := digest.FromReader(ts)
+		ts.Close()
+		if err != nil {
+			t.Errorf("Failed to read tar stream of layer %s after crash: %+v", chainID, err)
+		} else if layer.DiffID(dgst) != l.DiffID() {
+			t.Errorf("layer %s tar stream digest %s does not match diff id %s after crash", chainID, dgst, l.DiffID())
+		}
+	}
+
+	for _, name := range mountNames {
+		for _, get := range []func(string) (string, error){ms.GetMountID, ms.GetInitID} {
+			if id, err := get(name); err == nil && id != "" {
+				used[id] = true
+			}
+		}
+
+		rw, err := ls.GetRWLayer(name)
+		if err != nil {
+			t.Errorf("rw layer %s not loaded after crash: %+v", name, err)
+			continue
+		}
+		defer func(rw layer.RWLayer) {
+			if _, err := ls.ReleaseRWLayer(rw); err != nil {
+				t.Errorf("Failed to release rw layer %s after crash: %+v", rw.Name(), err)
+			}
+		}(rw)
+
+		if _, err := rw.Mount(""); err != nil {
+			t.Errorf("Failed to mount rw layer %s after crash: %+v", name, err)
+			continue
+		}
+		if err := rw.Unmount(); err != nil {
+			t.Errorf("Failed to unmount rw layer %s after crash: %+v", name, err)
+		}
+	}
+
+	orphans, err := orphanedIDs(root, used)
+	if err != nil {
+		t.Fatalf("Failed to check for orphaned driver directories: %+v", err)
+	}
+	for _, o := range orphans {
+		t.Errorf("orphaned driver directory %s after crash", o)
+	}
+}
+
+// crashTest returns a test which kills a process running layer store
+// operations during the given operation then checks the layer store.
+// The operation is killed after increasing delays until it completes
+// before being killed. When no operation is given the process is
+// killed once at a random point.
+func crashTest(op string) func(T) {
+	return func(t T) {
+		if op == "" {
+			crashAt(t, randomCrashPoint())
+			return
+		}
+		for delay := time.Duration(0); delay <= maxCrashDelay; delay = 2*delay + time.Millisecond {
+			if !crashAt(t, crashPoint{op: op, iteration: 1, delay: delay}) {
+				return
+			}
+		}
+	}
+}
+
+// maxCrashDelay is the longest delay before killing an operation
+const maxCrashDelay = time.Second
+
+// crashAt creates a layer store with a base layer, runs the crash
+// process on it killing it at the crash point and checks the layer
+// store. Returns whether the process was killed during the operation.
+func crashAt(t T, point crashPoint) bool {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := ls.(*layerStore)
+	if !ok {
+		cleanup(t, ls)
+		t.Skipf("layer store %T cannot be reopened", ls)
+	}
+
+	tar, err := TarFromFiles(
+		CreateDirectory("/etc", 0755),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+	)
+	if err != nil {
+		cleanup(t, ls)
+		t.Fatal(err)
+	}
+	base, err := ls.Register(bytes.NewReader(tar), "")
+	if err != nil {
+		cleanup(t, ls)
+		t.Fatalf("Failed to register base layer: %+v", err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("Failed to close layer store, kept %s: %+v", s.tempDir, err)
+	}
+
+	during, err := crash(s.tempDir, base.ChainID(), point)
+	if err != nil {
+		unmountAll(s.tempDir)
+		os.RemoveAll(s.tempDir)
+		t.Fatal(err)
+	}
+	if during {
+		t.Logf("killed during %s", point)
+	} else {
+		t.Logf("killed after %s", point)
+	}
+
+	checkCrashedStore(t, s.tempDir, base.ChainID())
+
+	return during
+}
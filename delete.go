@@ -0,0 +1,319 @@
+package dsdbench
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+const (
+	// deleteDepth is the depth of the directory trees deleted
+	deleteDepth = 16
+
+	// deleteFileSize is the size of each deleted file
+	deleteFileSize = 1 << 10
+
+	// reclaimTimeout is how long to wait for the space of a deleted
+	// layer to be reclaimed
+	reclaimTimeout = 10 * time.Second
+
+	// reclaimedRatio is the ratio of the space used by a layer which
+	// must be freed for the space to be reclaimed
+	reclaimedRatio = 0.9
+)
+
+// deleteFiles are the numbers of files in the deleted layers
+var deleteFiles = []struct {
+	name  string
+	files int
+	large bool
+}{
+	{"10", 10, false},
+	{"1k", 1000, false},
+	{"10k", 10000, false},
+	{"100k", 100000, false},
+	{"1M", 1000000, true},
+}
+
+// deleteModes are the driver options added for the delete benchmarks,
+// the deferred benchmarks delete devicemapper devices in the background
+// and are skipped for other drivers
+var deleteModes = []struct {
+	name    string
+	options []string
+}{
+	{"", nil},
+	{"Deferred", []string{"dm.use_deferred_removal=true", "dm.use_deferred_deletion=true"}},
+}
+
+func init() {
+	for _, m := range deleteModes {
+		for _, f := range deleteFiles {
+			opts := TarOptions{
+				Seed:  1,
+				Files: f.files,
+				Size:  int64(f.files) * deleteFileSize,
+				Depth: deleteDepth,
+			}
+			options := m.options
+			registerBenchmarks(
+				Benchmark{
+					Name: fmt.Sprintf("DeleteLayer%sFiles%s", f.name, m.name),
+					F: func(b *testing.B) {
+						benchmarkDeleteLayer(b, opts, options)
+					},
+					Large: f.large,
+				},
+				Benchmark{
+					Name: fmt.Sprintf("DeleteRWLayer%sFiles%s", f.name, m.name),
+					F: func(b *testing.B) {
+						benchmarkDeleteRWLayer(b, opts, options)
+					},
+					Large: f.large,
+				},
+			)
+		}
+	}
+}
+
+// freeSpace returns the free bytes of the filesystem containing path
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bfree) * st.Bsize, nil
+}
+
+// deleteStats measures the space reclaimed by deleting layers
+type deleteStats struct {
+	root string
+
+	// before is the free space before the deleted layer was created
+	// and used is the space used by the layer
+	before int64
+	used   int64
+
+	reclaimed float64
+	wait      time.Duration
+	deleted   int
+
+	// waited is the number of deletes for which the space was
+	// reclaimed before the timeout, the wait is only measured for
+	// these deletes
+	waited   int
+	timeouts int
+}
+
+// creating records the free space before a layer is created
+func (s *deleteStats) creating() (err error) {
+	s.before, err = freeSpace(s.root)
+	return err
+}
+
+// created records the space used by a created layer, files are synced
+// so space used by delayed allocation is included.
+func (s *deleteStats) created() error {
+	syscall.Sync()
+	free, err := freeSpace(s.root)
+	if err != nil {
+		return err
+	}
+	s.used = s.before - free
+	return nil
+}
+
+// deletedAt records the space reclaimed when the delete returned, then
+// waits for the space to be reclaimed by drivers which delete in the
+// background. A delete for which the space is not reclaimed within the
+// timeout is counted as a timeout rather than in the wait.
+func (s *deleteStats) deletedAt(start time.Time) error {
+	if s.used <= 0 {
+		return nil
+	}
+	freed := func() (float64, error) {
+		free, err := freeSpace(s.root)
+		if err != nil {
+			return 0, err
+		}
+		return float64(free-(s.before-s.used)) / float64(s.used), nil
+	}
+
+	ratio, err := freed()
+	if err != nil {
+		return err
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	s.reclaimed += ratio
+	s.deleted++
+
+	for ratio < reclaimedRatio {
+		if time.Since(start) >= reclaimTimeout {
+			s.timeouts++
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+		if ratio, err = freed(); err != nil {
+			return err
+		}
+	}
+	s.wait += time.Since(start)
+	s.waited++
+	return nil
+}
+
+// report reports the percentage of the space freed when the delete
+// returns, the time until the space is reclaimed and the percentage of
+// deletes for which the space was not reclaimed before the timeout
+func (s *deleteStats) report(b *testing.B) {
+	if s.deleted == 0 {
+		return
+	}
+	b.ReportMetric(100*s.reclaimed/float64(s.deleted), "%reclaimed")
+	if s.waited > 0 {
+		b.ReportMetric(float64(s.wait.Nanoseconds())/float64(s.waited), "reclaim-ns/op")
+	}
+	b.ReportMetric(100*float64(s.timeouts)/float64(s.deleted), "%timeouts")
+}
+
+// deleteLayerStore returns a layer store with the driver options added,
+// the benchmark is skipped when options are given for a driver other
+// than devicemapper.
+func deleteLayerStore(b *testing.B, options []string) layer.Store {
+	if len(options) > 0 && (config.Plugin != "" || config.Driver != "devicemapper") {
+		b.Skip("requires devicemapper")
+	}
+	ls, err := getLayerStoreOptions(options...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ls
+}
+
+// layerStoreRoot returns the directory of the layer store, used to
+// measure free space
+func layerStoreRoot(ls layer.Store) string {
+	if s, ok := ls.(*layerStore); ok {
+		return s.tempDir
+	}
+	if config.Root != "" {
+		return config.Root
+	}
+	return os.TempDir()
+}
+
+// benchmarkDeleteLayer times releasing a registered layer with the
+// generated files, which deletes the layer. The free space is
+// measured after each release to report whether the space is
+// reclaimed when the release returns.
+func benchmarkDeleteLayer(b *testing.B, opts TarOptions, options []string) {
+	b.StopTimer()
+	ls := deleteLayerStore(b, options)
+	defer cleanup(b, ls)
+
+	f, err := ioutil.TempFile("", "delete-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := GenerateTar(f, opts); err != nil {
+		b.Fatalf("Failed to generate tar: %v", err)
+	}
+
+	stats := &deleteStats{root: layerStoreRoot(ls)}
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if err := stats.creating(); err != nil {
+			b.Fatal(err)
+		}
+		l, err := ls.Register(f, "")
+		if err != nil {
+			b.Fatalf("Failed to register layer: %+v", err)
+		}
+		if err := stats.created(); err != nil {
+			b.Fatal(err)
+		}
+
+		start := time.Now()
+		b.StartTimer()
+		removed, err := ls.Release(l)
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("Failed to release layer: %+v", err)
+		}
+		if len(removed) != 1 {
+			b.Fatalf("unexpected %d layers removed, expected 1", len(removed))
+		}
+		if err := stats.deletedAt(start); err != nil {
+			b.Fatal(err)
+		}
+	}
+	stats.report(b)
+}
+
+// benchmarkDeleteRWLayer times releasing a read-write layer in which
+// the generated files were created, as when a container is removed.
+// The free space is measured after each release as for layers.
+func benchmarkDeleteRWLayer(b *testing.B, opts TarOptions, options []string) {
+	b.StopTimer()
+	ls := deleteLayerStore(b, options)
+	defer cleanup(b, ls)
+
+	l, err := CreateLayer(ls, "", InitWithFiles(
+		CreateDirectory("/etc", 0755),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+	))
+	if err != nil {
+		b.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l)
+
+	stats := &deleteStats{root: layerStoreRoot(ls)}
+	for i := 0; i < b.N; i++ {
+		if err := stats.creating(); err != nil {
+			b.Fatal(err)
+		}
+		rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), l.ChainID(), nil)
+		if err != nil {
+			b.Fatalf("Failed to create rw layer: %v", err)
+		}
+		p, err := rw.Mount("")
+		if err != nil {
+			b.Fatalf("Mount error: %v", err)
+		}
+		if err := generatedFiles(opts)(p); err != nil {
+			rw.Unmount()
+			b.Fatalf("Failed to create files: %v", err)
+		}
+		if err := rw.Unmount(); err != nil {
+			b.Fatalf("Unmount error: %v", err)
+		}
+		if err := stats.created(); err != nil {
+			b.Fatal(err)
+		}
+
+		start := time.Now()
+		b.StartTimer()
+		_, err = ls.ReleaseRWLayer(rw)
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("Failed to release rw layer: %+v", err)
+		}
+		if err := stats.deletedAt(start); err != nil {
+			b.Fatal(err)
+		}
+	}
+	stats.report(b)
+}
@@ -0,0 +1,144 @@
+package reference
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/stevvooe/continuity/sysx"
+)
+
+// copyDir copies the content of the source directory into the existing
+// destination directory. Ownership, permissions, times, extended
+// attributes and hard links are preserved. Sockets are not copied.
+func copyDir(src, dst string) error {
+	inodes := map[uint64]string{}
+	var dirs []string
+
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("unsupported file info for %s", path)
+		}
+
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(target, mode.Perm()); err != nil {
+					return err
+				}
+			}
+			// Directory times are set after the content is copied
+			dirs = append(dirs, rel)
+		case mode.IsRegular():
+			if st.Nlink > 1 {
+				if linked, ok := inodes[st.Ino]; ok {
+					return os.Link(linked, target)
+				}
+				inodes[st.Ino] = target
+			}
+			if err := copyFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode&os.ModeNamedPipe != 0, mode&os.ModeDevice != 0:
+			if err := syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return err
+			}
+		case mode&os.ModeSocket != 0:
+			return nil
+		default:
+			return errors.Errorf("unsupported file type %s for %s", mode, path)
+		}
+
+		if err := copyMetadata(path, target, fi, st); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		return setTimes(target, st)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err := setTimes(filepath.Join(dst, dirs[i]), fi.Sys().(*syscall.Stat_t)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return err
+	}
+	return df.Close()
+}
+
+// copyMetadata copies ownership, extended attributes and permissions,
+// permissions are set last since changing ownership clears setuid.
+func copyMetadata(src, dst string, fi os.FileInfo, st *syscall.Stat_t) error {
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+
+	xattrs, err := sysx.LListxattr(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list xattrs on %s", src)
+	}
+	for _, xattr := range xattrs {
+		value, err := sysx.LGetxattr(src, xattr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get xattr %s on %s", xattr, src)
+		}
+		if err := sysx.LSetxattr(dst, xattr, value, 0); err != nil {
+			return errors.Wrapf(err, "failed to set xattr %s on %s", xattr, dst)
+		}
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return syscall.Chmod(dst, st.Mode&07777)
+}
+
+func setTimes(path string, st *syscall.Stat_t) error {
+	return system.LUtimesNano(path, []syscall.Timespec{st.Atim, st.Mtim})
+}
@@ -0,0 +1,254 @@
+// Package reference provides a graph driver which stores every layer as
+// a full copy of its parent. The driver requires no kernel support or
+// privileges and is used as a known correct baseline for other drivers.
+package reference
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/pkg/errors"
+)
+
+const driverName = "reference"
+
+func init() {
+	graphdriver.Register(driverName, Init)
+}
+
+// Init returns a new reference driver using the provided home directory.
+// No driver options are supported.
+func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+	if len(options) > 0 {
+		return nil, errors.Errorf("%s: unknown option %s", driverName, options[0])
+	}
+	if err := os.MkdirAll(filepath.Join(home, "dir"), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create driver root")
+	}
+
+	d := &Driver{
+		home: home,
+	}
+
+	return &diffDriver{
+		Driver:  graphdriver.NewNaiveDiffDriver(d, uidMaps, gidMaps),
+		proto:   d,
+		uidMaps: uidMaps,
+		gidMaps: gidMaps,
+	}, nil
+}
+
+// Driver holds each layer in a directory which starts as a copy of
+// the parent directory.
+type Driver struct {
+	home string
+}
+
+func (d *Driver) String() string {
+	return driverName
+}
+
+// Status returns the root directory of the driver
+func (d *Driver) Status() [][2]string {
+	return [][2]string{{"Root Dir", d.home}}
+}
+
+// GetMetadata returns no metadata, layer directories are not mounted
+func (d *Driver) GetMetadata(id string) (map[string]string, error) {
+	return nil, nil
+}
+
+// Cleanup does nothing, the driver holds no resources
+func (d *Driver) Cleanup() error {
+	return nil
+}
+
+// CreateReadWrite creates a layer which is the same as a read only layer
+func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts) error {
+	return d.Create(id, parent, opts)
+}
+
+// Create creates a layer directory with a copy of the parent content
+func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (err error) {
+	if opts != nil && len(opts.StorageOpt) > 0 {
+		return errors.Errorf("%s: storage options not supported", driverName)
+	}
+
+	dir := d.dir(id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create layer directory")
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if parent == "" {
+		return nil
+	}
+	if err := copyDir(d.dir(parent), dir); err != nil {
+		return errors.Wrapf(err, "failed to copy parent %s", parent)
+	}
+	return nil
+}
+
+func (d *Driver) dir(id string) string {
+	return filepath.Join(d.home, "dir", filepath.Base(id))
+}
+
+// Remove removes the layer directory
+func (d *Driver) Remove(id string) error {
+	if err := os.RemoveAll(d.dir(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Get returns the layer directory, no mount is done
+func (d *Driver) Get(id, mountLabel string) (string, error) {
+	dir := d.dir(id)
+	if fi, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !fi.IsDir() {
+		return "", errors.Errorf("%s: not a directory", dir)
+	}
+	return dir, nil
+}
+
+// Put does nothing since Get does not mount
+func (d *Driver) Put(id string) error {
+	return nil
+}
+
+// Exists returns whether the layer directory exists
+func (d *Driver) Exists(id string) bool {
+	_, err := os.Stat(d.dir(id))
+	return err == nil
+}
+
+// diffDriver applies diffs without the chroot used by the naive diff
+// driver, which would require the caller to be privileged.
+//
+// Layers are extracted from tar with modified times truncated to the
+// second, the naive diff driver only detects changes made in a later
+// second than the parent was extracted.
+type diffDriver struct {
+	graphdriver.Driver
+
+	proto   graphdriver.ProtoDriver
+	uidMaps []idtools.IDMap
+	gidMaps []idtools.IDMap
+}
+
+func (d *diffDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	dir, err := d.proto.Get(id, "")
+	if err != nil {
+		return 0, err
+	}
+	defer d.proto.Put(id)
+
+	return archive.ApplyUncompressedLayer(dir, diff, &archive.TarOptions{
+		UIDMaps: d.uidMaps,
+		GIDMaps: d.gidMaps,
+	})
+}
+
+// Diff produces the diff of a layer like the naive diff driver, but
+// includes every path of a hard link group when any path in the group
+// changed so that links to files in lower layers are preserved. The
+// diff of a layer without a parent also waits until the next second
+// boundary, as the naive diff driver does for layers with a parent, so
+// that later changes have a different modified time.
+func (d *diffDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	start := time.Now()
+
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	if parent == "" {
+		rc, err = d.Driver.Diff(id, parent)
+	} else {
+		rc, err = d.exportChanges(id, parent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		err := rc.Close()
+		time.Sleep(start.Truncate(time.Second).Add(time.Second).Sub(time.Now()))
+		return err
+	}), nil
+}
+
+func (d *diffDriver) exportChanges(id, parent string) (io.ReadCloser, error) {
+	changes, err := d.Driver.Changes(id, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := d.proto.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	defer d.proto.Put(id)
+
+	changes, err = addLinkChanges(dir, changes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find hard links")
+	}
+
+	return archive.ExportChanges(dir, changes, d.uidMaps, d.gidMaps)
+}
+
+// addLinkChanges adds every path linked to an added or modified file
+// as a modified path.
+func addLinkChanges(dir string, changes []archive.Change) ([]archive.Change, error) {
+	linked := map[uint64]bool{}
+	changed := map[string]bool{}
+	for _, c := range changes {
+		changed[c.Path] = true
+		if c.Kind == archive.ChangeDelete {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(dir, c.Path))
+		if err != nil {
+			return nil, err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			linked[st.Ino] = true
+		}
+	}
+	if len(linked) == 0 {
+		return changes, nil
+	}
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || !fi.Mode().IsRegular() || !linked[st.Ino] {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.Join("/", rel)
+		if !changed[rel] {
+			changes = append(changes, archive.Change{Path: rel, Kind: archive.ChangeModify})
+		}
+		return nil
+	})
+	return changes, err
+}
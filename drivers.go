@@ -0,0 +1,8 @@
+package dsdbench
+
+import (
+	_ "github.com/dmcgowan/dsdbench/driver/reference"
+	_ "github.com/docker/docker/daemon/graphdriver/aufs"
+	_ "github.com/docker/docker/daemon/graphdriver/overlay"
+	_ "github.com/docker/docker/daemon/graphdriver/overlay2"
+)
@@ -0,0 +1,11 @@
+//go:build linux && !exclude_graphdriver_devicemapper
+// +build linux,!exclude_graphdriver_devicemapper
+
+package dsdbench
+
+import (
+	// The devicemapper driver requires the libdevmapper headers to
+	// build, it is excluded with the exclude_graphdriver_devicemapper
+	// build tag as in the docker daemon.
+	_ "github.com/docker/docker/daemon/graphdriver/devmapper"
+)
@@ -0,0 +1,229 @@
+package dsdbench
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// exportShape is the content of an exported layer
+type exportShape struct {
+	name string
+
+	// parents are the layers below the exported layer
+	parents []LayerInit
+
+	// files create the content of the exported layer on its parents
+	files ApplyFile
+
+	// large benchmarks are skipped unless enabled
+	large bool
+}
+
+var exportShapes = []exportShape{
+	{
+		name: "SmallFiles",
+		files: generatedFiles(TarOptions{
+			Seed:         1,
+			Files:        10000,
+			Size:         40 << 20,
+			Distribution: EqualSizes,
+		}),
+	},
+	{
+		name: "LargeFiles",
+		files: generatedFiles(TarOptions{
+			Seed:         1,
+			Files:        2,
+			Size:         512 << 20,
+			Distribution: EqualSizes,
+		}),
+		large: true,
+	},
+	{
+		name:    "DeepWhiteouts",
+		parents: []LayerInit{InitWithFiles(deepTree("/tree", 12, 8)...)},
+		files:   deepTreeChanges("/tree", 12, 8),
+	},
+}
+
+// exportMethods are the ways a layer is exported given the layer and
+// a read-write layer on the same parent with the same changes
+var exportMethods = []struct {
+	name   string
+	export func(l layer.Layer, rw layer.RWLayer) (io.ReadCloser, error)
+}{
+	// TarStream assembles the registered tar from the tar-split
+	// metadata and the driver's files, as done by save and push
+	{"TarStream", func(l layer.Layer, rw layer.RWLayer) (io.ReadCloser, error) {
+		return l.TarStream()
+	}},
+	// Diff gets the tar directly from the driver, drivers using the
+	// naive diff wait until the next second after the diff is read
+	{"Diff", func(l layer.Layer, rw layer.RWLayer) (io.ReadCloser, error) {
+		var parent layer.ChainID
+		if p := l.Parent(); p != nil {
+			parent = p.ChainID()
+		}
+		return l.TarStreamFrom(parent)
+	}},
+	// RWDiff gets the tar of the read-write layer's changes from the
+	// driver, as done by commit
+	{"RWDiff", func(l layer.Layer, rw layer.RWLayer) (io.ReadCloser, error) {
+		return rw.TarStream()
+	}},
+}
+
+func init() {
+	for _, m := range exportMethods {
+		for _, s := range exportShapes {
+			m, s := m, s
+			registerBenchmarks(Benchmark{
+				Name: fmt.Sprintf("Export%s%s", m.name, s.name),
+				F: func(b *testing.B) {
+					benchmarkExport(b, s, m.export)
+				},
+				Large: s.large,
+			})
+		}
+	}
+}
+
+// generatedFiles returns a file applier which extracts a tar created
+// by GenerateTar with the given options
+func generatedFiles(opts TarOptions) ApplyFile {
+	return func(root string) error {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(GenerateTar(pw, opts))
+		}()
+		defer pr.Close()
+		return archive.Untar(pr, root, nil)
+	}
+}
+
+// deepTree returns file appliers creating a tree of nested directories
+// of the given depth, each directory has the given number of files.
+func deepTree(root string, depth, files int) []ApplyFile {
+	var appliers []ApplyFile
+	dir := root
+	for i := 0; i < depth; i++ {
+		appliers = append(appliers, CreateDirectory(dir, 0755))
+		for j := 0; j < files; j++ {
+			appliers = append(appliers, NewTestFile(fmt.Sprintf("%s/f%d", dir, j), []byte(dir), 0644))
+		}
+		appliers = append(appliers, CreateDirectory(dir+"/side", 0755))
+		appliers = append(appliers, NewTestFile(dir+"/side/f", []byte(dir), 0644))
+		dir = fmt.Sprintf("%s/d%d", dir, i)
+	}
+	return appliers
+}
+
+// deepTreeChanges returns a file applier making changes at every level
+// of a tree created by deepTree which are exported with whiteouts:
+// removing every other file, removing a directory and replacing a
+// directory, which is opaque in the exported layer.
+func deepTreeChanges(root string, depth, files int) ApplyFile {
+	var appliers []ApplyFile
+	dir := root
+	for i := 0; i < depth; i++ {
+		for j := 0; j < files; j += 2 {
+			appliers = append(appliers, RemoveFile(fmt.Sprintf("%s/f%d", dir, j)))
+		}
+		if i%2 == 0 {
+			appliers = append(appliers, RemoveFile(dir+"/side"))
+		} else {
+			appliers = append(appliers,
+				RemoveFile(dir+"/side"),
+				CreateDirectory(dir+"/side", 0755),
+				NewTestFile(dir+"/side/g", []byte(dir), 0644),
+			)
+		}
+		appliers = append(appliers, NewTestFile(dir+"/added", []byte(dir), 0644))
+		dir = fmt.Sprintf("%s/d%d", dir, i)
+	}
+	return func(root string) error {
+		for _, a := range appliers {
+			if err := a(root); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// exportSize reads the exported tar and returns its size
+func exportSize(rc io.ReadCloser, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(ioutil.Discard, rc)
+}
+
+// benchmarkExport times reading the tar of a layer with the given
+// shape. The layer is exported once before timing to get the size of
+// the tar and so each iteration reads from a warm cache.
+func benchmarkExport(b *testing.B, shape exportShape, export func(layer.Layer, layer.RWLayer) (io.ReadCloser, error)) {
+	b.StopTimer()
+	ls, err := getLayerStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup(b, ls)
+
+	var parent layer.ChainID
+	if len(shape.parents) > 0 {
+		p, err := CreateLayerChain(ls, shape.parents...)
+		if err != nil {
+			b.Fatalf("Failed to create layer chain: %+v", err)
+		}
+		defer ls.Release(p)
+		parent = p.ChainID()
+	}
+
+	l, err := CreateLayer(ls, parent, InitWithFiles(shape.files))
+	if err != nil {
+		b.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l)
+
+	rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), parent, nil)
+	if err != nil {
+		b.Fatalf("Failed to create rw layer: %v", err)
+	}
+	defer ls.ReleaseRWLayer(rw)
+	p, err := rw.Mount("")
+	if err != nil {
+		b.Fatalf("Mount error: %v", err)
+	}
+	if err := shape.files(p); err != nil {
+		rw.Unmount()
+		b.Fatal(err)
+	}
+	if err := rw.Unmount(); err != nil {
+		b.Fatalf("Unmount error: %v", err)
+	}
+
+	size, err := exportSize(export(l, rw))
+	if err != nil {
+		b.Fatalf("Export error: %+v", err)
+	}
+
+	b.SetBytes(size)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := exportSize(export(l, rw))
+		if err != nil {
+			b.Fatalf("Export error: %+v", err)
+		}
+		if n != size {
+			b.Fatalf("unexpected export size %d, expected %d", n, size)
+		}
+	}
+}
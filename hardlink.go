@@ -0,0 +1,99 @@
+package dsdbench
+
+import (
+	"archive/tar"
+
+	"github.com/docker/docker/layer"
+)
+
+func init() {
+	registerTests(
+		Test{Name: "HardlinkCreate", F: testHardlinkCreate},
+		Test{Name: "HardlinkLowerLayer", F: testHardlinkLowerLayer},
+		Test{Name: "HardlinkCopyUp", F: testHardlinkCopyUp},
+		Test{Name: "HardlinkRemove", F: testHardlinkRemove},
+	)
+}
+
+// tarLinks returns a check that each group of paths is stored as hard
+// links in the tar stream of the layer
+func tarLinks(groups ...[]string) layerCheck {
+	return func(l layer.Layer) error {
+		return CheckTarLinks(l, groups...)
+	}
+}
+
+func testHardlinkCreate(t T) {
+	l1Init := InitWithFiles(
+		CreateDirectory("/bin", 0755),
+		NewTestFile("/bin/busybox", []byte("#!/bin/busybox"), 0755),
+		Link("/bin/busybox", "/bin/sh"),
+		Link("/bin/busybox", "/bin/ls"),
+		CreateDirectory("/usr/bin", 0755),
+		Link("/bin/busybox", "/usr/bin/env"),
+	)
+
+	simpleLayerTest(t, tarLinks(
+		[]string{"/bin/busybox", "/bin/ls", "/bin/sh", "/usr/bin/env"},
+	), l1Init)
+}
+
+// testHardlinkLowerLayer links to a file in a lower layer, the
+// link target must be in the same layer as the link for the link
+// to be preserved when the layer is exported.
+func testHardlinkLowerLayer(t T) {
+	l1Init := InitWithFiles(
+		CreateDirectory("/bin", 0755),
+		NewTestFile("/bin/busybox", []byte("#!/bin/busybox"), 0755),
+	)
+	l2Init := InitWithFiles(
+		Link("/bin/busybox", "/bin/sh"),
+	)
+
+	simpleLayerTest(t, tarLinks(
+		[]string{"/bin/busybox", "/bin/sh"},
+	), l1Init, l2Init)
+}
+
+// testHardlinkCopyUp updates one link of a group from a lower layer,
+// all links must see the update and remain linked.
+func testHardlinkCopyUp(t T) {
+	l1Init := InitWithFiles(
+		CreateDirectory("/etc", 0755),
+		NewTestFile("/etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\n"), 0644),
+		Link("/etc/passwd", "/etc/passwd-"),
+	)
+	l2Init := InitWithFiles(
+		NewTestFile("/etc/passwd", []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644),
+	)
+
+	simpleLayerTest(t, tarLinks(
+		[]string{"/etc/passwd", "/etc/passwd-"},
+	), l1Init, l2Init)
+}
+
+// testHardlinkRemove removes one link of a group from a lower layer,
+// only the removed link is whited out and the remaining links stay
+// linked in the lower layer.
+func testHardlinkRemove(t T) {
+	l1Init := InitWithFiles(
+		CreateDirectory("/bin", 0755),
+		NewTestFile("/bin/busybox", []byte("#!/bin/busybox"), 0755),
+		Link("/bin/busybox", "/bin/sh"),
+		Link("/bin/busybox", "/bin/ls"),
+	)
+	l2Init := InitWithFiles(
+		RemoveFile("/bin/sh"),
+	)
+
+	simpleLayerTest(t, func(l layer.Layer) error {
+		if err := checkTarEntries(l, map[string]tarEntry{
+			"/bin/.wh.sh":  {typeflag: tar.TypeReg},
+			"/bin/busybox": {},
+			"/bin/ls":      {},
+		}); err != nil {
+			return err
+		}
+		return CheckTarLinks(l.Parent(), []string{"/bin/busybox", "/bin/ls", "/bin/sh"})
+	}, l1Init, l2Init)
+}
@@ -0,0 +1,152 @@
+package dsdbench
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Issue is a known upstream issue which a storage driver
+// configuration may be affected by.
+type Issue struct {
+	// ID is the short identifier of the issue, such as docker#21555
+	ID string
+
+	// URL links to the upstream issue
+	URL string
+
+	// Description briefly describes the issue
+	Description string
+
+	// Drivers are the graph drivers known to be affected, empty
+	// when the issue is not specific to any driver.
+	Drivers []string
+
+	// Kernel holds notes on which kernel versions are affected
+	Kernel string
+
+	// Test is the name of the test which checks for the issue
+	Test string
+
+	// Check is the test function which fails when the storage
+	// configuration is affected by the issue.
+	Check func(T)
+}
+
+// Affects returns whether the issue is known to affect the driver
+func (i Issue) Affects(driver string) bool {
+	if len(i.Drivers) == 0 {
+		return true
+	}
+	for _, d := range i.Drivers {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the issue as its identifier with its description
+func (i Issue) String() string {
+	return fmt.Sprintf("%s (%s)", i.ID, i.Description)
+}
+
+// IssueReporter is implemented by a T which records when a test
+// found the behavior of the known issues it checks for, as opposed to
+// failing to set up the test.
+type IssueReporter interface {
+	IssueFound()
+}
+
+var (
+	issues []Issue
+
+	// issueChecks records whether each running issue check found
+	// the issue
+	issueChecks   = map[T]bool{}
+	issueChecksMu sync.Mutex
+)
+
+// issueFound records that the running check found the behavior of the
+// known issues it checks for, it is called before failing the test on
+// the specific check.
+func issueFound(t T) {
+	issueChecksMu.Lock()
+	defer issueChecksMu.Unlock()
+	if _, ok := issueChecks[t]; ok {
+		issueChecks[t] = true
+	}
+}
+
+// registerIssue registers a test which checks for the provided
+// known issues. When the test fails because the issue was found it
+// is logged with the issues which may cause it for the configured
+// driver.
+func registerIssue(name string, check func(T), known ...Issue) {
+	for i := range known {
+		known[i].Test = name
+		known[i].Check = check
+	}
+	issues = append(issues, known...)
+
+	registerTests(Test{
+		Name: name,
+		F: func(t T) {
+			issueChecksMu.Lock()
+			issueChecks[t] = false
+			issueChecksMu.Unlock()
+			defer func() {
+				issueChecksMu.Lock()
+				found := issueChecks[t]
+				delete(issueChecks, t)
+				issueChecksMu.Unlock()
+				if !found {
+					return
+				}
+				if r, ok := t.(IssueReporter); ok {
+					r.IssueFound()
+				}
+				if config.DriverName() == "" {
+					return
+				}
+				affected := AffectedIssues(name, config.DriverName())
+				for _, i := range affected {
+					t.Logf("%s is affected by %s, see %s", config.DriverName(), i, i.URL)
+				}
+				if len(affected) == 0 {
+					for _, i := range TestIssues(name) {
+						t.Logf("%s may be affected by an issue similar to %s, see %s", config.DriverName(), i, i.URL)
+					}
+				}
+			}()
+			check(t)
+		},
+	})
+}
+
+// Issues returns all the registered known issues
+func Issues() []Issue {
+	return append([]Issue(nil), issues...)
+}
+
+// TestIssues returns the known issues checked by the named test
+func TestIssues(test string) []Issue {
+	var checked []Issue
+	for _, i := range issues {
+		if i.Test == test {
+			checked = append(checked, i)
+		}
+	}
+	return checked
+}
+
+// AffectedIssues returns the known issues checked by the named
+// test which are known to affect the driver.
+func AffectedIssues(test, driver string) []Issue {
+	var affected []Issue
+	for _, i := range TestIssues(test) {
+		if i.Affects(driver) {
+			affected = append(affected, i)
+		}
+	}
+	return affected
+}
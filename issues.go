@@ -0,0 +1,930 @@
+package dsdbench
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	registerTests(
+		Test{Name: "FileInodeStability", F: testFileInodeStability},
+	)
+
+	registerProcess("listen", listenProcess)
+	registerProcess("getcwd", getcwdProcess)
+	registerProcess("openfile", openfileProcess)
+
+	registerIssue("LayerFileUpdate", testLayerFileUpdate, Issue{
+		ID:          "docker#21555",
+		URL:         "https://github.com/docker/docker/issues/21555",
+		Description: "file updated in upper layer keeps lower content",
+		Drivers:     []string{"overlay", "devicemapper"},
+	})
+	registerIssue("RemoveDirectoryInLowerLayer", testRemoveDirectoryInLowerLayer, Issue{
+		ID:          "docker#25244",
+		URL:         "https://github.com/docker/docker/issues/25244",
+		Description: "removed lower layer directory content reappears",
+	})
+	registerIssue("RemoveAfterCommit", testRemoveAfterCommit, Issue{
+		ID:          "docker#24309",
+		URL:         "https://github.com/docker/docker/issues/24309",
+		Description: "removal of committed content",
+	})
+	registerIssue("UnixDomainSockets", testUnixDomainSockets, Issue{
+		ID:          "docker#12080",
+		URL:         "https://github.com/docker/docker/issues/12080",
+		Description: "unix domain sockets in layers",
+	})
+	registerIssue("DirectoryInodeStability", testDirectoryInodeStability, Issue{
+		ID:          "docker#19647",
+		URL:         "https://github.com/docker/docker/issues/19647",
+		Description: "directory inode changes on copy up",
+		Drivers:     []string{"overlay", "overlay2"},
+	})
+	registerIssue("OpenFileInodeStability", testOpenFileInodeStability, Issue{
+		ID:          "docker#12327",
+		URL:         "https://github.com/docker/docker/issues/12327",
+		Description: "open file does not see changes after copy up",
+		Drivers:     []string{"overlay", "overlay2"},
+		Kernel:      "overlay files opened read only before copy up see the lower file until Linux 4.19",
+	})
+	registerIssue("GetCWD", testGetCWD, Issue{
+		ID:          "docker#19082",
+		URL:         "https://github.com/docker/docker/issues/19082",
+		Description: "getcwd fails after working directory copy up",
+		Drivers:     []string{"overlay", "overlay2"},
+	})
+	registerIssue("Chmod", testChmod, Issue{
+		ID:          "docker/machine#3327",
+		URL:         "https://github.com/docker/machine/issues/3327",
+		Description: "chmod of lower layer file not committed",
+		Drivers:     []string{"aufs"},
+	})
+	registerIssue("Chown", testChown,
+		Issue{
+			ID:          "docker#20240",
+			URL:         "https://github.com/docker/docker/issues/20240",
+			Description: "chown on aufs",
+			Drivers:     []string{"aufs"},
+		},
+		Issue{
+			ID:          "docker#24913",
+			URL:         "https://github.com/docker/docker/issues/24913",
+			Description: "chown on overlay",
+			Drivers:     []string{"overlay"},
+		},
+		Issue{
+			ID:          "docker#28391",
+			URL:         "https://github.com/docker/docker/issues/28391",
+			Description: "chown on overlay2",
+			Drivers:     []string{"overlay2"},
+		},
+	)
+	registerIssue("Rename", testRename, Issue{
+		ID:          "docker#25409",
+		URL:         "https://github.com/docker/docker/issues/25409",
+		Description: "rename of lower layer directory fails",
+		Drivers:     []string{"overlay", "overlay2"},
+		Kernel:      "overlay returns EXDEV for lower layer directories unless redirect_dir is enabled, Linux 4.10 and later",
+	})
+	registerIssue("DirectoryPermissionOnCommit", testDirectoryPermissionOnCommit, Issue{
+		ID:          "docker#27298",
+		URL:         "https://github.com/docker/docker/issues/27298",
+		Description: "directory ownership lost on commit",
+	})
+}
+
+// testLayerFileUpdate tests the update of a single file in an upper layer
+// Known sporadic failure in overlay, possible in all except overlay2 and aufs
+// See https://github.com/docker/docker/issues/21555
+func testLayerFileUpdate(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	l1Init := InitWithFiles(
+		CreateDirectory("/etc", 0700),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+		NewTestFile("/etc/profile", []byte("PATH=/usr/bin"), 0644),
+	)
+	l2Init := InitWithFiles(
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.2"), 0644),
+		NewTestFile("/etc/profile", []byte("PATH=/usr/bin"), 0666),
+		CreateDirectory("/root", 0700),
+		NewTestFile("/root/.bashrc", []byte("PATH=/usr/sbin:/usr/bin"), 0644),
+	)
+
+	var sleepTime time.Duration
+
+	// run 5 times to account for sporadic failure
+	for i := 0; i < 5; i++ {
+		time.Sleep(sleepTime)
+
+		l, err := CreateLayerChain(ls, l1Init, l2Init)
+		if err != nil {
+			t.Fatalf("Failed to create layer chain: %+v", err)
+		}
+
+		if err := CheckLayer(ls, l.ChainID(), l1Init, l2Init); err != nil {
+			issueFound(t)
+			t.Fatalf("Layer check failure: %+v", err)
+		}
+
+		if _, err := ls.Release(l); err != nil {
+			t.Fatal(err)
+		}
+
+		// Sleep until next second boundary before running again
+		nextTime := time.Now()
+		sleepTime = time.Unix(nextTime.Unix()+1, 0).Sub(nextTime)
+	}
+}
+
+// See https://github.com/docker/docker/issues/25244
+func testRemoveDirectoryInLowerLayer(t T) {
+	l1Init := InitWithFiles(
+		CreateDirectory("/lib", 0700),
+		NewTestFile("/lib/hidden", []byte{}, 0644),
+	)
+	l2Init := InitWithFiles(
+		RemoveFile("/lib"),
+		CreateDirectory("/lib", 0700),
+		NewTestFile("/lib/not-hidden", []byte{}, 0644),
+	)
+	l3Init := InitWithFiles(
+		NewTestFile("/lib/newfile", []byte{}, 0644),
+	)
+
+	simpleLayerTest(t, nil, l1Init, l2Init, l3Init)
+}
+
+// See https://github.com/docker/docker/issues/24309
+func testRemoveAfterCommit(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	// run several commit cycles to catch state kept between commits
+	const cycles = 5
+
+	files := []ApplyFile{
+		CreateDirectory("/usr/lib/app/plugins", 0755),
+		NewTestFile("/usr/lib/app/lib.so", []byte("lib"), 0755),
+		CreateDirectory("/tmp/build/obj", 0755),
+		NewTestFile("/tmp/build/obj/main.o", []byte("obj"), 0644),
+		NewTestFile("/tmp/build/Makefile", []byte("all:"), 0644),
+		CreateDirectory("/var/cache/d0", 0755),
+		NewTestFile("/var/cache/d0/f", []byte("0"), 0644),
+		NewTestFile("/var/cache/c0", []byte("0"), 0644),
+	}
+	for i := 0; i < cycles; i++ {
+		files = append(files, NewTestFile(fmt.Sprintf("/usr/lib/app/plugins/p%d.so", i), []byte("plugin"), 0755))
+	}
+	inits := []LayerInit{InitWithFiles(files...)}
+
+	l, err := CreateLayer(ls, "", inits[0])
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+
+	for i := 1; i <= cycles; i++ {
+		// Remove files and directories committed by the previous
+		// cycle and the base layer, add files for the next cycle
+		li := InitWithFiles(
+			RemoveFile(fmt.Sprintf("/var/cache/c%d", i-1)),
+			RemoveFile(fmt.Sprintf("/var/cache/d%d", i-1)),
+			RemoveFile(fmt.Sprintf("/usr/lib/app/plugins/p%d.so", i-1)),
+			RemoveFile("/tmp/build"),
+			CreateDirectory("/tmp/build", 0755),
+			NewTestFile(fmt.Sprintf("/tmp/build/%d.o", i), []byte("obj"), 0644),
+			CreateDirectory(fmt.Sprintf("/var/cache/d%d", i), 0755),
+			NewTestFile(fmt.Sprintf("/var/cache/d%d/f", i), []byte{byte('0' + i)}, 0644),
+			NewTestFile(fmt.Sprintf("/var/cache/c%d", i), []byte{byte('0' + i)}, 0644),
+		)
+		inits = append(inits, li)
+
+		previous := l
+		l, err = CreateLayer(ls, previous.ChainID(), li)
+		if err != nil {
+			t.Fatalf("Failed to commit cycle %d: %+v", i, err)
+		}
+		if _, err := ls.Release(previous); err != nil {
+			t.Fatalf("Failed to release cycle %d: %+v", i-1, err)
+		}
+
+		if err := CheckLayer(ls, l.ChainID(), inits...); err != nil {
+			issueFound(t)
+			t.Fatalf("Layer check failure in cycle %d: %+v", i, err)
+		}
+
+		if err := checkTarEntries(l, map[string]tarEntry{
+			fmt.Sprintf("/var/cache/.wh.c%d", i-1):              {typeflag: tar.TypeReg},
+			fmt.Sprintf("/var/cache/.wh.d%d", i-1):              {typeflag: tar.TypeReg},
+			fmt.Sprintf("/usr/lib/app/plugins/.wh.p%d.so", i-1): {typeflag: tar.TypeReg},
+			fmt.Sprintf("/var/cache/c%d", i):                    {typeflag: tar.TypeReg},
+			fmt.Sprintf("/var/cache/d%d/f", i):                  {typeflag: tar.TypeReg},
+			fmt.Sprintf("/var/cache/c%d", i-1):                  {},
+			fmt.Sprintf("/var/cache/d%d/f", i-1):                {},
+			"/usr/lib/app/lib.so":                               {},
+		}); err != nil {
+			issueFound(t)
+			t.Fatalf("Tar stream check failure in cycle %d: %+v", i, err)
+		}
+	}
+
+	if _, err := ls.Release(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenProcess listens on the unix socket path given as the argument
+// and sends a message to the first connection.
+func listenProcess(p *ProcessContext, args []string) error {
+	l, err := net.Listen("unix", args[0])
+	if err != nil {
+		return err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	defer l.Close()
+
+	if err := p.Report("listening on %s", args[0]); err != nil {
+		return err
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	return err
+}
+
+// See https://github.com/docker/docker/issues/12080
+func testUnixDomainSockets(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	dirs := []ApplyFile{
+		CreateDirectory("/run", 0755),
+		CreateDirectory("/var/run", 0755),
+	}
+	l1Init := InitWithFiles(append(dirs, CreateSocket("/var/run/lower.sock"))...)
+
+	l1, err := CreateLayer(ls, "", l1Init)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l1)
+
+	// Sockets can not be stored in a tar and are not committed
+	if err := checkTarEntries(l1, map[string]tarEntry{"/var/run/lower.sock": {}}); err != nil {
+		issueFound(t)
+		t.Fatalf("Tar stream check failure: %+v", err)
+	}
+
+	rw, p, release := mountRWLayer(t, ls, l1.ChainID())
+	defer release()
+
+	// Listen from a process in the layer in a directory copied up
+	// from the lower layer
+	proc, err := StartProcess(p, "listen", "run/docker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	if _, err := proc.Result(); err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+
+	dir, err := os.Open(filepath.Join(p, "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	conn, err := net.Dial("unix", socketPath(dir, "docker.sock"))
+	if err != nil {
+		issueFound(t)
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer conn.Close()
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		issueFound(t)
+		t.Fatalf("Failed to read from socket: %v", err)
+	}
+	if string(b) != "ping" {
+		issueFound(t)
+		t.Fatalf("Unexpected message %q, expected %q", b, "ping")
+	}
+	if err := proc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(p, "run", "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		issueFound(t)
+		t.Fatalf("Unexpected mode %s for socket", fi.Mode())
+	}
+
+	ts, err := rw.TarStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	l2, err := ls.Register(ts, l1.ChainID())
+	if err != nil {
+		issueFound(t)
+		t.Fatalf("Failed to commit layer with socket: %+v", err)
+	}
+	defer ls.Release(l2)
+
+	if err := CheckLayer(ls, l2.ChainID(), InitWithFiles(dirs...)); err != nil {
+		issueFound(t)
+		t.Fatalf("Layer check failure: %+v", err)
+	}
+	if err := checkTarEntries(l2, map[string]tarEntry{"/run/docker.sock": {}}); err != nil {
+		issueFound(t)
+		t.Fatalf("Tar stream check failure: %+v", err)
+	}
+}
+
+// inode identifies a file by device and inode number
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+func (i inode) String() string {
+	return fmt.Sprintf("%d:%d", i.dev, i.ino)
+}
+
+func statInode(fi os.FileInfo) inode {
+	st := fi.Sys().(*syscall.Stat_t)
+	return inode{dev: uint64(st.Dev), ino: st.Ino}
+}
+
+// inodes returns the inode of each path in the root
+func inodes(root string, paths []string) (map[string]inode, error) {
+	m := map[string]inode{}
+	for _, p := range paths {
+		fi, err := os.Lstat(filepath.Join(root, p))
+		if err != nil {
+			return nil, err
+		}
+		m[p] = statInode(fi)
+	}
+	return m, nil
+}
+
+// inodeStabilityLayers are the layers of the inode stability tests
+func inodeStabilityLayers() []LayerInit {
+	return []LayerInit{
+		InitWithFiles(
+			CreateDirectory("/etc/conf.d", 0755),
+			NewTestFile("/etc/conf.d/a", []byte("a"), 0644),
+			CreateDirectory("/usr/share/doc", 0755),
+			NewTestFile("/usr/share/doc/README", []byte("readme"), 0644),
+			CreateDirectory("/var/log", 0755),
+			CreateDirectory("/home/user", 0755),
+			NewTestFile("/home/user/.profile", []byte("PATH=/usr/bin"), 0644),
+		),
+		InitWithFiles(
+			NewTestFile("/var/log/messages", []byte("log"), 0644),
+		),
+	}
+}
+
+// inodeStabilityChanges copies up directories and files through
+// content changes and metadata changes of the directories and the
+// files in them
+var inodeStabilityChanges = InitWithFiles(
+	NewTestFile("/etc/conf.d/b", []byte("b"), 0644),
+	NewTestFile("/etc/conf.d/a", []byte("updated"), 0644),
+	Chmod("/usr/share", 0700),
+	Chmod("/usr/share/doc/README", 0600),
+	NewTestFile("/var/log/messages", []byte("more log"), 0644),
+	Chmod("/home/user/.profile", 0600),
+)
+
+// inodeStabilityTest checks that the inodes of the paths in a mounted
+// read-write layer are unchanged after copy up and after the layer is
+// remounted.
+func inodeStabilityTest(t T, paths []string) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	l, err := CreateLayerChain(ls, inodeStabilityLayers()...)
+	if err != nil {
+		t.Fatalf("Failed to create layer chain: %+v", err)
+	}
+	defer ls.Release(l)
+
+	rw, p, release := mountRWLayer(t, ls, l.ChainID())
+	defer release()
+
+	before, err := inodes(p, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inodeStabilityChanges(p); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := inodes(p, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if before[path] != after[path] {
+			issueFound(t)
+			t.Errorf("Inode of %s changed after copy up: %s -> %s", path, before[path], after[path])
+		}
+	}
+
+	if err := rw.Unmount(); err != nil {
+		t.Fatalf("Unmount error: %+v", err)
+	}
+	if p, err = rw.Mount(""); err != nil {
+		t.Fatalf("Mount error: %+v", err)
+	}
+
+	remounted, err := inodes(p, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if after[path] != remounted[path] {
+			issueFound(t)
+			t.Errorf("Inode of %s changed after remount: %s -> %s", path, after[path], remounted[path])
+		}
+	}
+}
+
+// See https://github.com/docker/docker/issues/19647
+func testDirectoryInodeStability(t T) {
+	inodeStabilityTest(t, []string{
+		"/etc",
+		"/etc/conf.d",
+		"/usr/share",
+		"/usr/share/doc",
+		"/var/log",
+		"/home/user",
+	})
+}
+
+// testFileInodeStability checks the inodes of files copied up, the
+// inodes of open files are checked by testOpenFileInodeStability.
+func testFileInodeStability(t T) {
+	inodeStabilityTest(t, []string{
+		"/etc/conf.d/a",
+		"/usr/share/doc/README",
+		"/var/log/messages",
+		"/home/user/.profile",
+	})
+}
+
+// openfileProcess opens each file given as a relative path read only
+// and reports the inode of the open file. Once the test continues the
+// content and inode of each open file are reported.
+func openfileProcess(p *ProcessContext, args []string) error {
+	files := make([]*os.File, len(args))
+	for i, name := range args {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if err := p.Wait(); err != nil {
+				return err
+			}
+		}
+
+		for _, f := range files {
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if err := p.Report("%s", statInode(fi)); err != nil {
+				return err
+			}
+			if i == 0 {
+				continue
+			}
+
+			b := make([]byte, fi.Size())
+			n, err := f.ReadAt(b, 0)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err := p.Report("%s", b[:n]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// See https://github.com/docker/docker/issues/12327
+func testOpenFileInodeStability(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	l1Init := InitWithFiles(
+		CreateDirectory("/etc", 0755),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+		NewTestFile("/etc/resolv.conf", []byte("nameserver 10.0.0.1"), 0644),
+	)
+	l2Init := InitWithFiles(
+		NewTestFile("/etc/hostname", []byte("mydomain"), 0644),
+	)
+
+	l, err := CreateLayerChain(ls, l1Init, l2Init)
+	if err != nil {
+		t.Fatalf("Failed to create layer chain: %+v", err)
+	}
+	defer ls.Release(l)
+
+	_, p, release := mountRWLayer(t, ls, l.ChainID())
+	defer release()
+
+	paths := []string{"/etc/hosts", "/etc/resolv.conf", "/etc/hostname"}
+	before, err := inodes(p, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := StartProcess(p, "openfile", "etc/hosts", "etc/resolv.conf", "etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	checkResults(t, proc, "before copy up",
+		before["/etc/hosts"].String(),
+		before["/etc/resolv.conf"].String(),
+		before["/etc/hostname"].String(),
+	)
+
+	// Copy up through a content change and a metadata change while
+	// the files are open, including a file from the top layer
+	if err := InitWithFiles(
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.2"), 0644),
+		Chmod("/etc/resolv.conf", 0600),
+		NewTestFile("/etc/hostname", []byte("otherdomain"), 0644),
+	)(p); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := inodes(p, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if before[path] != after[path] {
+			issueFound(t)
+			t.Errorf("Inode of %s changed after copy up: %s -> %s", path, before[path], after[path])
+		}
+	}
+
+	if err := proc.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	checkResults(t, proc, "after copy up",
+		after["/etc/hosts"].String(), "mydomain 10.0.0.2",
+		after["/etc/resolv.conf"].String(), "nameserver 10.0.0.1",
+		after["/etc/hostname"].String(), "otherdomain",
+	)
+
+	if err := proc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getcwdProcess changes to the directory given as the first argument
+// and reports the working directory followed by the content of each
+// file given as a relative path in the remaining arguments. Once the
+// test continues the results are reported again.
+func getcwdProcess(p *ProcessContext, args []string) error {
+	if err := os.Chdir(args[0]); err != nil {
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if err := p.Wait(); err != nil {
+				return err
+			}
+		}
+
+		// Use getcwd directly since os.Getwd may return $PWD
+		cwd, err := syscall.Getwd()
+		if err != nil {
+			cwd = "error: " + err.Error()
+		}
+		if err := p.Report("%s", cwd); err != nil {
+			return err
+		}
+
+		for _, name := range args[1:] {
+			b, err := ioutil.ReadFile(name)
+			if err != nil {
+				b = []byte("error: " + err.Error())
+			}
+			if err := p.Report("%s", b); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// See https://github.com/docker/docker/issues/19082
+func testGetCWD(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	l1Init := InitWithFiles(
+		CreateDirectory("/var/lib/app/data", 0755),
+		NewTestFile("/var/lib/app/config", []byte("lower config"), 0644),
+		NewTestFile("/var/lib/app/data/db", []byte("lower data"), 0644),
+	)
+
+	l1, err := CreateLayer(ls, "", l1Init)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l1)
+
+	_, p, release := mountRWLayer(t, ls, l1.ChainID())
+	defer release()
+
+	proc, err := StartProcess(p, "getcwd", "var/lib/app", "config", "data/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	expected := []string{proc.Path("/var/lib/app"), "lower config", "lower data"}
+	checkResults(t, proc, "before copy up", expected...)
+
+	// Copy up the working directory and its parents by writing into
+	// it from outside the process
+	if err := InitWithFiles(
+		NewTestFile("/var/lib/app/new", []byte("new"), 0644),
+		NewTestFile("/var/lib/app/data/db", []byte("upper data"), 0644),
+	)(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := proc.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{proc.Path("/var/lib/app"), "lower config", "upper data"}
+	checkResults(t, proc, "after copy up", expected...)
+
+	if err := proc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tarMode returns the permission and special bits of a file mode as
+// stored in a tar header
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// checkTarModes checks the permission and special bits of entries in
+// the layer's tar stream
+func checkTarModes(l layer.Layer, modes map[string]os.FileMode) error {
+	headers, err := TarHeaders(l)
+	if err != nil {
+		return err
+	}
+
+	for p, mode := range modes {
+		hdr, ok := headers[p]
+		if !ok {
+			return errors.Errorf("missing %s in tar stream", p)
+		}
+		if actual, expected := hdr.Mode&07777, tarMode(mode); actual != expected {
+			return errors.Errorf("unexpected mode %04o for %s in tar stream, expected %04o", actual, p, expected)
+		}
+	}
+
+	return nil
+}
+
+// chmodCase is a lower layer file or directory which has its mode
+// changed from one mode to another in the upper layer
+type chmodCase struct {
+	path     string
+	dir      bool
+	from, to os.FileMode
+}
+
+var chmodCases = []chmodCase{
+	{path: "/files/private", from: 0644, to: 0600},
+	{path: "/files/exec", from: 0644, to: 0755},
+	{path: "/files/readonly", from: 0666, to: 0444},
+	{path: "/files/setuid", from: 0755, to: os.ModeSetuid | 0755},
+	{path: "/files/setgid", from: 0755, to: os.ModeSetgid | 0755},
+	{path: "/files/unsetuid", from: os.ModeSetuid | 0755, to: 0755},
+	{path: "/dirs/private", dir: true, from: 0755, to: 0700},
+	{path: "/dirs/public", dir: true, from: 0700, to: 0777},
+	{path: "/dirs/sticky", dir: true, from: 0777, to: os.ModeSticky | 0777},
+	{path: "/dirs/unsticky", dir: true, from: os.ModeSticky | 0777, to: 0755},
+	{path: "/dirs/setgid", dir: true, from: 0755, to: os.ModeSetgid | 0775},
+}
+
+// See https://github.com/docker/machine/issues/3327
+func testChmod(t T) {
+	lower := []ApplyFile{
+		CreateDirectory("/files", 0755),
+		CreateDirectory("/dirs", 0755),
+	}
+	var upper []ApplyFile
+	modes := map[string]os.FileMode{}
+	for _, c := range chmodCases {
+		if c.dir {
+			lower = append(lower,
+				CreateDirectory(c.path, 0755),
+				NewTestFile(filepath.Join(c.path, "file"), []byte(c.path), 0644),
+			)
+		} else {
+			lower = append(lower, NewTestFile(c.path, []byte(c.path), 0644))
+		}
+		lower = append(lower, Chmod(c.path, c.from))
+		upper = append(upper, Chmod(c.path, c.to))
+		modes[c.path] = c.to
+	}
+
+	// Changing the mode through a symlink changes the lower layer
+	// target, the symlink itself is unchanged.
+	lower = append(lower,
+		CreateDirectory("/bin", 0755),
+		NewTestFile("/bin/busybox", []byte("#!/bin/busybox"), 0644),
+		Symlink("busybox", "/bin/sh"),
+		Symlink("dirs/linked", "/linked"),
+		CreateDirectory("/dirs/linked", 0755),
+	)
+	upper = append(upper,
+		Chmod("/bin/sh", 0755),
+		Chmod("/linked", 0700),
+	)
+	modes["/bin/busybox"] = 0755
+	modes["/dirs/linked"] = 0700
+
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	layers := []LayerInit{InitWithFiles(lower...), InitWithFiles(upper...)}
+	l, err := CreateLayerChain(ls, layers...)
+	if err != nil {
+		t.Fatalf("Failed to create layer chain: %+v", err)
+	}
+	defer func(l layer.Layer) {
+		if _, err := ls.Release(l); err != nil {
+			t.Fatal(err)
+		}
+	}(l)
+
+	if err := CheckLayer(ls, l.ChainID(), layers...); err != nil {
+		issueFound(t)
+		t.Fatalf("Layer check failure: %+v", err)
+	}
+	if err := checkTarModes(l, modes); err != nil {
+		issueFound(t)
+		t.Fatalf("Tar stream check failure: %+v", err)
+	}
+}
+
+// See https://github.com/docker/docker/issues/20240 aufs
+// See https://github.com/docker/docker/issues/24913 overlay
+// see https://github.com/docker/docker/issues/28391 overlay2
+func testChown(t T) {
+	requireRoot(t)
+
+	l1Init := InitWithFiles(
+		CreateDirectory("/opt", 0700),
+		CreateDirectory("/opt/a", 0700),
+		CreateDirectory("/opt/a/b", 0700),
+		NewTestFile("/opt/a/b/file.txt", []byte("hello"), 0644),
+	)
+	l2Init := InitWithFiles(
+		Chown("/opt", 1, 1),
+		Chown("/opt/a", 1, 1),
+		Chown("/opt/a/b", 1, 1),
+		Chown("/opt/a/b/file.txt", 1, 1),
+	)
+
+	simpleLayerTest(t, nil, l1Init, l2Init)
+}
+
+// https://github.com/docker/docker/issues/25409
+func testRename(t T) {
+	l1Init := InitWithFiles(
+		CreateDirectory("/dir1", 0700),
+		CreateDirectory("/somefiles", 0700),
+		NewTestFile("/somefiles/f1", []byte("was here first!"), 0644),
+		NewTestFile("/somefiles/f2", []byte("nothing interesting"), 0644),
+	)
+	l2Init := InitWithFiles(
+		Rename("/dir1", "/dir2"),
+		NewTestFile("/somefiles/f1-overwrite", []byte("new content 1"), 0644),
+		Rename("/somefiles/f1-overwrite", "/somefiles/f1"),
+		Rename("/somefiles/f2", "/somefiles/f3"),
+	)
+
+	simpleLayerTest(t, nil, l1Init, l2Init)
+}
+
+// https://github.com/docker/docker/issues/27298
+func testDirectoryPermissionOnCommit(t T) {
+	requireRoot(t)
+
+	l1Init := InitWithFiles(
+		CreateDirectory("/dir1", 0700),
+		CreateDirectory("/dir2", 0700),
+		CreateDirectory("/dir3", 0700),
+		CreateDirectory("/dir4", 0700),
+		NewTestFile("/dir4/f1", []byte("..."), 0644),
+		CreateDirectory("/dir5", 0700),
+		NewTestFile("/dir5/f1", []byte("..."), 0644),
+		Chown("/dir1", 1, 1),
+		Chown("/dir2", 1, 1),
+		Chown("/dir3", 1, 1),
+		Chown("/dir5", 1, 1),
+		Chown("/dir5/f1", 1, 1),
+	)
+	l2Init := InitWithFiles(
+		Chown("/dir2", 0, 0),
+		RemoveFile("/dir3"),
+		Chown("/dir4", 1, 1),
+		Chown("/dir4/f1", 1, 1),
+	)
+	l3Init := InitWithFiles(
+		CreateDirectory("/dir3", 0700),
+		Chown("/dir3", 1, 1),
+		RemoveFile("/dir5"),
+		CreateDirectory("/dir5", 0700),
+		Chown("/dir5", 1, 1),
+	)
+
+	simpleLayerTest(t, nil, l1Init, l2Init, l3Init)
+}
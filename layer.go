@@ -3,52 +3,115 @@ package dsdbench
 import (
 	"bytes"
 	"fmt"
-	"testing"
+	"os"
 
 	"github.com/docker/docker/layer"
-	"github.com/docker/docker/pkg/reexec"
-
-	_ "github.com/docker/docker/daemon/graphdriver/aufs"
-	_ "github.com/docker/docker/daemon/graphdriver/devmapper"
-	_ "github.com/docker/docker/daemon/graphdriver/overlay"
-	_ "github.com/docker/docker/daemon/graphdriver/overlay2"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/pkg/errors"
 )
 
 func init() {
-	reexec.Init()
+	registerTests(
+		Test{Name: "LayerCreate", F: testLayerCreate},
+		Test{Name: "FileDeletion", F: testFileDeletion},
+		Test{Name: "DirectoryReplace", F: testDirectoryReplace},
+		Test{Name: "TarRegister", F: testTarRegister},
+		Test{Name: "Mount1to125Layers", F: testMount1to125Layers},
+	)
 }
 
-func cleanup(t testing.TB, ls layer.Store) {
+// cleanup cleans up the layer store, failing the test unless only the
+// temp dir could not be removed.
+func cleanup(t T, ls layer.Store) {
 	if err := ls.Cleanup(); err != nil {
-		t.Logf("cleanup error: %v", err)
+		if _, ok := errors.Cause(err).(removeError); ok {
+			t.Logf("cleanup error: %v", err)
+			return
+		}
+		t.Errorf("cleanup error: %v", err)
 	}
 }
 
+// requireRoot skips the test when not run as root, such as tests
+// which change file ownership.
+func requireRoot(t T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+}
+
+// layerCheck checks the top layer of a test beyond its content, such
+// as its tar stream
+type layerCheck func(layer.Layer) error
+
 // simpleLayersTest creates a layer chain made up of the layer init
 // functions and compares it with a flat directory with all the
-// layer initilizers applied.
-func simpleLayerTest(t *testing.T, layers ...LayerInit) {
+// layer initilizers applied. The check is run on the top layer when
+// not nil.
+func simpleLayerTest(t T, check layerCheck, layers ...LayerInit) {
+	layerTest(t, func(ls layer.Store) (layer.Layer, error) {
+		return CreateLayerChain(ls, layers...)
+	}, layers, check)
+}
+
+// layerTest creates a layer and compares it with a flat directory with
+// the expected layer initializers applied, then runs the check on the
+// layer when not nil.
+func layerTest(t T, create func(layer.Store) (layer.Layer, error), expected []LayerInit, check layerCheck) {
 	ls, err := getLayerStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer cleanup(t, ls)
 
-	l, err := CreateLayerChain(ls, layers...)
+	l, err := create(ls)
 	if err != nil {
-		t.Fatalf("Failed to create layer chain: %+v", err)
+		t.Fatalf("Failed to create layer: %+v", err)
 	}
+	defer func(l layer.Layer) {
+		if _, err := ls.Release(l); err != nil {
+			t.Fatal(err)
+		}
+	}(l)
 
-	if err := CheckLayer(ls, l.ChainID(), layers...); err != nil {
+	if err := CheckLayer(ls, l.ChainID(), expected...); err != nil {
+		issueFound(t)
 		t.Fatalf("Layer check failure: %+v", err)
 	}
 
-	if _, err := ls.Release(l); err != nil {
-		t.Fatal(err)
+	if check != nil {
+		if err := check(l); err != nil {
+			issueFound(t)
+			t.Fatalf("Tar stream check failure: %+v", err)
+		}
 	}
 }
 
-func TestLayerCreate(t *testing.T) {
+// mountRWLayer creates and mounts a read-write layer on top of the
+// parent layer, the returned function unmounts and releases the layer.
+func mountRWLayer(t T, ls layer.Store, parent layer.ChainID) (layer.RWLayer, string, func()) {
+	rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), parent, nil)
+	if err != nil {
+		t.Fatalf("Failed to create rw layer: %+v", err)
+	}
+
+	p, err := rw.Mount("")
+	if err != nil {
+		ls.ReleaseRWLayer(rw)
+		t.Fatalf("Failed to mount: %+v", err)
+	}
+
+	return rw, p, func() {
+		if err := rw.Unmount(); err != nil {
+			t.Errorf("Failed to unmount: %+v", err)
+		}
+		if _, err := ls.ReleaseRWLayer(rw); err != nil {
+			t.Errorf("Failed to release rw layer: %+v", err)
+		}
+	}
+}
+
+func testLayerCreate(t T) {
 	l1Init := InitWithFiles(
 		CreateDirectory("/etc", 0755),
 		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
@@ -61,10 +124,10 @@ func TestLayerCreate(t *testing.T) {
 		NewTestFile("/root/.bashrc", []byte("PATH=/usr/sbin:/usr/bin"), 0644),
 	)
 
-	simpleLayerTest(t, l1Init, l2Init)
+	simpleLayerTest(t, nil, l1Init, l2Init)
 }
 
-func TestFileDeletion(t *testing.T) {
+func testFileDeletion(t T) {
 	l1Init := InitWithFiles(
 		CreateDirectory("/test/somedir", 0755),
 	)
@@ -80,10 +143,10 @@ func TestFileDeletion(t *testing.T) {
 		RemoveFile("/test/otherdir"),
 	)
 
-	simpleLayerTest(t, l1Init, l2Init, l3Init)
+	simpleLayerTest(t, nil, l1Init, l2Init, l3Init)
 }
 
-func TestDirectoryReplace(t *testing.T) {
+func testDirectoryReplace(t T) {
 	l1Init := InitWithFiles(
 		CreateDirectory("/test/something", 0755),
 		NewTestFile("/test/something/f1", []byte{'1'}, 0644),
@@ -94,10 +157,10 @@ func TestDirectoryReplace(t *testing.T) {
 		NewTestFile("/test/something", []byte("something new!"), 0644),
 	)
 
-	simpleLayerTest(t, l1Init, l2Init)
+	simpleLayerTest(t, nil, l1Init, l2Init)
 }
 
-func TestTarRegister(t *testing.T) {
+func testTarRegister(t T) {
 	ls, err := getLayerStore()
 	if err != nil {
 		t.Fatal(err)
@@ -142,7 +205,7 @@ func TestTarRegister(t *testing.T) {
 	}
 }
 
-func TestMount1to125Layers(t *testing.T) {
+func testMount1to125Layers(t T) {
 	ls, err := getLayerStore()
 	if err != nil {
 		t.Fatal(err)
@@ -190,8 +253,3 @@ func TestMount1to125Layers(t *testing.T) {
 		t.Fatalf("layer %d release error: %+v", max, err)
 	}
 }
-
-// TODO: Run basic POSIX operations tests
-func TestPosix(t *testing.T) {
-	t.Skip("Not implemented")
-}
@@ -1,70 +1,274 @@
 package dsdbench
 
 import (
-	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
+	"github.com/dmcgowan/dsdbench/plugin"
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/plugingetter"
 	"github.com/pkg/errors"
 )
 
-var (
-	testDirectory string
-	keepTestDir   bool
-)
+// Config is the storage configuration used to create the layer
+// store for each test and benchmark.
+type Config struct {
+	// Driver is the name of the graph driver
+	Driver string
+
+	// DriverOptions are the options passed to the graph driver
+	DriverOptions []string
+
+	// Plugin is the path to the unix socket or spec file of a graph
+	// driver plugin. When set the driver is named after the plugin.
+	Plugin string
+
+	// Proxy runs the driver as a plugin served from this process
+	Proxy bool
+
+	// Root is the directory in which test directories are created,
+	// the system temp directory is used when empty.
+	Root string
+
+	// Keep keeps test directories after the layer store is cleaned up
+	Keep bool
+
+	// ForceUnmount unmounts any mounts left under a test directory
+	// when the layer store is cleaned up, the leaked mounts are still
+	// reported as an error.
+	ForceUnmount bool
+
+	// LargeBenchmarks runs the benchmarks which use 256MB or more of
+	// data or a million files
+	LargeBenchmarks bool
+
+	// DropCaches drops the system caches before each iteration of
+	// the cold cache benchmarks, which requires root
+	DropCaches bool
+
+	// StressDuration is how long the stress test runs operations, the
+	// stress test is skipped when zero
+	StressDuration time.Duration
+
+	// StressConcurrency is the number of goroutines running operations
+	// in the stress test, the stress test is skipped when zero
+	StressConcurrency int
+}
+
+var config Config
+
+// Configure sets the storage configuration used by all following
+// tests and benchmarks.
+func Configure(c Config) {
+	config = c
+}
 
-func init() {
-	flag.StringVar(&testDirectory, "dir", "", "Default root of test directory")
-	flag.BoolVar(&keepTestDir, "keep", false, "Keep test file directory")
+// CheckConfig checks that a layer store can be created using the
+// current storage configuration.
+func CheckConfig() error {
+	ls, err := getLayerStore()
+	if err != nil {
+		return err
+	}
+	return ls.Cleanup()
 }
 
 type layerStore struct {
 	layer.Store
 
 	tempDir string
+	plugin  io.Closer
+
+	// options are the driver options added to the configured options
+	options []string
+
+	// mounts are the mountpoints under the temp dir before the layer
+	// store was created
+	mounts []string
 }
 
+// Cleanup shuts down the layer store and removes the temp dir. Any
+// mounts left under the temp dir are returned as a mountLeakError, the
+// temp dir is kept unless the leaked mounts are forcibly unmounted. An
+// error shutting down the layer store is included in the leak error. A
+// failure to remove the temp dir is returned as a removeError.
 func (ls *layerStore) Cleanup() error {
-	if err := ls.Store.Cleanup(); err != nil {
-		return errors.Wrapf(err, "cleanup error, kept %s", ls.tempDir)
+	closeErr := ls.close()
+
+	mounts, err := mountsUnder(ls.tempDir)
+	if err != nil {
+		if closeErr != nil {
+			return errors.Wrapf(err, "failed to get mounts after cleanup error %v, kept %s", closeErr, ls.tempDir)
+		}
+		return errors.Wrapf(err, "failed to get mounts, kept %s", ls.tempDir)
+	}
+	if leaked := mountDiff(mounts, ls.mounts); len(leaked) > 0 {
+		var leakErr error = mountLeakError(leaked)
+		if closeErr != nil {
+			leakErr = errors.Wrapf(leakErr, "cleanup error %v", closeErr)
+		}
+		if !config.ForceUnmount {
+			return errors.Wrapf(leakErr, "kept %s", ls.tempDir)
+		}
+		if err := forceUnmount(leaked); err != nil {
+			return errors.Wrapf(leakErr, "%v, kept %s", err, ls.tempDir)
+		}
+		if !config.Keep {
+			os.RemoveAll(ls.tempDir)
+		}
+		return errors.Wrap(leakErr, "unmounted")
+	}
+
+	if closeErr != nil {
+		return errors.Wrapf(closeErr, "cleanup error, kept %s", ls.tempDir)
 	}
-	if keepTestDir {
+	if config.Keep {
 		fmt.Printf("Kept root directory: %s\n", ls.tempDir)
 		return nil
 	}
-	return os.RemoveAll(ls.tempDir)
+	if err := os.RemoveAll(ls.tempDir); err != nil {
+		return removeError{err}
+	}
+	return nil
+}
+
+// removeError is returned when the layer store was cleaned up but its
+// temp dir could not be removed
+type removeError struct {
+	error
+}
+
+// close shuts down the graph driver and plugin server, leaving the
+// layers in the root directory.
+func (ls *layerStore) close() error {
+	if err := ls.Store.Cleanup(); err != nil {
+		return err
+	}
+	if ls.plugin != nil {
+		if err := ls.plugin.Close(); err != nil {
+			return errors.Wrap(err, "failed to close plugin server")
+		}
+	}
+	return nil
+}
+
+// reopenLayerStore shuts down the layer store and creates a new layer
+// store from the same root directory, as when the daemon is restarted.
+// The returned store replaces the given store, which must not be used
+// or cleaned up after being reopened. On error the given store must
+// still be cleaned up.
+func reopenLayerStore(ls layer.Store) (layer.Store, error) {
+	s, ok := ls.(*layerStore)
+	if !ok {
+		return nil, errors.Errorf("layer store %T cannot be reopened", ls)
+	}
+	if err := s.close(); err != nil {
+		return nil, errors.Wrapf(err, "failed to close layer store, kept %s", s.tempDir)
+	}
+
+	reopened, err := openLayerStore(s.tempDir, s.options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reopen layer store, kept %s", s.tempDir)
+	}
+	reopened.mounts = s.mounts
+	return reopened, nil
+}
+
+// DriverName returns the name of the graph driver, plugins are named
+// after the plugin socket or spec file.
+func (c Config) DriverName() string {
+	if c.Plugin != "" {
+		return pluginName(c.Plugin)
+	}
+	return c.Driver
 }
 
 func getLayerStore() (layer.Store, error) {
-	td, err := ioutil.TempDir(testDirectory, "layer-test-")
+	return getLayerStoreOptions()
+}
+
+// getLayerStoreOptions creates a layer store in a new temp dir with the
+// driver options added to the configured driver options.
+func getLayerStoreOptions(options ...string) (_ layer.Store, err error) {
+	if config.Driver == "" && config.Plugin == "" {
+		return nil, errors.New("no graphdriver specified")
+	}
+
+	td, err := ioutil.TempDir(config.Root, "layer-test-")
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create temp dir")
 	}
 
-	driverName := os.Getenv("DOCKER_GRAPHDRIVER")
-	if driverName == "" {
-		return nil, errors.New("no graphdriver specified")
+	mounts, err := mountsUnder(td)
+	if err != nil {
+		os.RemoveAll(td)
+		return nil, errors.Wrap(err, "failed to get mounts")
 	}
 
-	var driverOptions []string
-	if options := os.Getenv("DOCKER_GRAPHDRIVER_OPTIONS"); options != "" {
-		driverOptions = strings.Split(options, " ")
+	ls, err := openLayerStore(td, options...)
+	if err != nil {
+		os.RemoveAll(td)
+		return nil, err
 	}
+	ls.mounts = mounts
+	return ls, nil
+}
 
+// openLayerStore creates a layer store using the configured graph
+// driver with the root directory, any layers already in the root
+// directory are loaded. The driver options are added to the configured
+// driver options.
+func openLayerStore(td string, driverOptions ...string) (_ *layerStore, err error) {
 	options := graphdriver.Options{
 		Root:          td,
-		DriverOptions: driverOptions,
+		DriverOptions: append(append([]string{}, config.DriverOptions...), driverOptions...),
 	}
 
-	gd, err := graphdriver.GetDriver(driverName, nil, options)
+	name := config.DriverName()
+	var (
+		pg     plugingetter.PluginGetter
+		server io.Closer
+	)
+	if config.Proxy || config.Plugin != "" {
+		path := config.Plugin
+		if config.Proxy {
+			path = filepath.Join(td, "proxy.sock")
+			server, err = plugin.NewServer(name).Listen(path)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to start plugin server")
+			}
+			defer func() {
+				if err != nil {
+					server.Close()
+				}
+			}()
+			name = pluginName(path)
+		}
+
+		p, err := loadPlugin(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load plugin")
+		}
+		pg = pluginGetter{plugin: p}
+		options.ExperimentalEnabled = true
+		name = pluginDriverName(name)
+	}
+
+	gd, err := graphdriver.GetDriver(name, pg, options)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get graph driver")
 	}
+	defer func() {
+		if err != nil {
+			gd.Cleanup()
+		}
+	}()
+
 	fms, err := layer.NewFSMetadataStore(filepath.Join(td, "layer"))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get metadata store")
@@ -78,5 +282,7 @@ func getLayerStore() (layer.Store, error) {
 	return &layerStore{
 		Store:   ls,
 		tempDir: td,
+		plugin:  server,
+		options: driverOptions,
 	}, nil
 }
@@ -0,0 +1,266 @@
+package dsdbench
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataDirFiles is the number of files in the large directory,
+	// spread across all the layers
+	metadataDirFiles = 10000
+
+	// metadataStats is the number of files stat'ed in each iteration
+	metadataStats = 100
+
+	// metadataLookupDepth is the number of directories a looked up
+	// file is nested in
+	metadataLookupDepth = 16
+)
+
+// metadataDepths are the numbers of layers below the mount
+var metadataDepths = []int{1, 5, 25, 125}
+
+// metadataOps are the operations on the merged view of the layers,
+// each is given the mount path, the depth and the number of files in
+// the merged view
+var metadataOps = []struct {
+	name string
+	op   func(root string, depth, expected int) error
+}{
+	{"Stat", metadataStat},
+	{"Lookup", metadataLookup},
+	{"Readdir", metadataReaddir},
+	{"Walk", metadataWalk},
+}
+
+func init() {
+	for _, m := range metadataOps {
+		for _, depth := range metadataDepths {
+			for _, cold := range []bool{false, true} {
+				m, depth, cold := m, depth, cold
+				cache := "Hot"
+				if cold {
+					cache = "Cold"
+				}
+				registerBenchmarks(Benchmark{
+					Name: fmt.Sprintf("Metadata%sDepth%d%s", m.name, depth, cache),
+					F: func(b *testing.B) {
+						benchmarkMetadata(b, depth, cold, m.op)
+					},
+				})
+			}
+		}
+	}
+}
+
+// metadataFile returns the path of a file in the large directory added
+// by the given layer
+func metadataFile(l, i int) string {
+	return fmt.Sprintf("/shared/l%d-f%d", l, i)
+}
+
+// lookupPath returns the path of the deeply nested directory in the
+// lowest layer
+func lookupPath() string {
+	dir := "/deep"
+	for i := 0; i < metadataLookupDepth; i++ {
+		dir = fmt.Sprintf("%s/d%d", dir, i)
+	}
+	return dir
+}
+
+// metadataLayers returns the layer initializers for the given depth,
+// the lowest layer has a deeply nested file and each layer adds its
+// share of the files in the large directory.
+func metadataLayers(depth int) []LayerInit {
+	inits := make([]LayerInit, depth)
+	for l := range inits {
+		var files []ApplyFile
+		if l == 0 {
+			files = append(files, CreateDirectory("/shared", 0755))
+			dir := "/deep"
+			files = append(files, CreateDirectory(dir, 0755))
+			for i := 0; i < metadataLookupDepth; i++ {
+				dir = fmt.Sprintf("%s/d%d", dir, i)
+				files = append(files, CreateDirectory(dir, 0755))
+			}
+			files = append(files, NewTestFile(dir+"/target", []byte("target"), 0644))
+		}
+		for i := 0; i < metadataDirFiles/depth; i++ {
+			files = append(files, NewTestFile(metadataFile(l, i), nil, 0644))
+		}
+		inits[l] = InitWithFiles(files...)
+	}
+	return inits
+}
+
+// metadataStat stats files added by each of the layers
+func metadataStat(root string, depth, expected int) error {
+	for k := 0; k < metadataStats; k++ {
+		if _, err := os.Lstat(filepath.Join(root, metadataFile(k%depth, k/depth))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataLookup looks up a deeply nested file in the lowest layer and
+// a missing file beside it, which is looked up in every layer
+func metadataLookup(root string, depth, expected int) error {
+	p := filepath.Join(root, lookupPath())
+	if _, err := os.Lstat(filepath.Join(p, "target")); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(filepath.Join(p, "missing")); !os.IsNotExist(err) {
+		return errors.Errorf("unexpected lookup error %v, expected not exist", err)
+	}
+	return nil
+}
+
+// metadataReaddir reads the names in the large directory
+func metadataReaddir(root string, depth, expected int) error {
+	f, err := os.Open(filepath.Join(root, "shared"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	if n := depth * (metadataDirFiles / depth); len(names) != n {
+		return errors.Errorf("unexpected %d entries, expected %d", len(names), n)
+	}
+	return nil
+}
+
+// metadataWalk walks the whole tree, stat'ing every file
+func metadataWalk(root string, depth, expected int) error {
+	n, err := walkCount(root)
+	if err != nil {
+		return err
+	}
+	if n != expected {
+		return errors.Errorf("unexpected %d files walked, expected %d", n, expected)
+	}
+	return nil
+}
+
+// walkCount returns the number of files in the tree
+func walkCount(root string) (int, error) {
+	var n int
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// dropCaches drops the system page, dentry and inode caches
+func dropCaches() error {
+	syscall.Sync()
+	return ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("3"), 0200)
+}
+
+// benchmarkMetadata times the operation on the mount of a read-write
+// layer on a chain of the given depth. With a cold cache the layer is
+// remounted before each iteration, dropping the cache of the merged
+// view, and the system caches are dropped when configured.
+func benchmarkMetadata(b *testing.B, depth int, cold bool, op func(string, int, int) error) {
+	b.StopTimer()
+	if cold && config.DropCaches && os.Geteuid() != 0 {
+		b.Skip("dropping caches requires root")
+	}
+
+	ls, err := getLayerStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup(b, ls)
+
+	inits := metadataLayers(depth)
+	l, err := CreateLayerChain(ls, inits...)
+	if err != nil {
+		b.Fatalf("Failed to create layer chain: %+v", err)
+	}
+	defer ls.Release(l)
+
+	td, err := ioutil.TempDir("", "metadata-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for _, li := range inits {
+		if err := li(td); err != nil {
+			b.Fatal(err)
+		}
+	}
+	expected, err := walkCount(td)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rw, err := ls.CreateRWLayer(stringid.GenerateRandomID(), l.ChainID(), nil)
+	if err != nil {
+		b.Fatalf("Failed to create rw layer: %v", err)
+	}
+	defer ls.ReleaseRWLayer(rw)
+
+	p, err := rw.Mount("")
+	if err != nil {
+		b.Fatalf("Mount error: %v", err)
+	}
+	defer func() {
+		if err := rw.Unmount(); err != nil {
+			b.Errorf("Unmount error: %v", err)
+		}
+	}()
+
+	// Check and warm the cache
+	if err := op(p, depth, expected); err != nil {
+		b.Fatalf("Metadata check failure: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		if cold {
+			if p, err = remount(rw); err != nil {
+				b.Fatal(err)
+			}
+			if config.DropCaches {
+				if err := dropCaches(); err != nil {
+					b.Fatalf("Failed to drop caches: %v", err)
+				}
+			}
+		}
+		b.StartTimer()
+		err := op(p, depth, expected)
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("Metadata error: %v", err)
+		}
+	}
+}
+
+// remount unmounts and mounts the read-write layer
+func remount(rw layer.RWLayer) (string, error) {
+	if err := rw.Unmount(); err != nil {
+		return "", errors.Wrap(err, "unmount error")
+	}
+	p, err := rw.Mount("")
+	if err != nil {
+		return "", errors.Wrap(err, "mount error")
+	}
+	return p, nil
+}
@@ -0,0 +1,89 @@
+package dsdbench
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/pkg/errors"
+)
+
+// mountLeakError is returned when cleaning up a layer store which left
+// mounts behind, the value is the leaked mountpoints.
+type mountLeakError []string
+
+func (e mountLeakError) Error() string {
+	return "leaked mounts: " + strings.Join(e, ", ")
+}
+
+// mountsUnder returns the mountpoints under the root in the order
+// they were mounted. The root is resolved to the absolute path without
+// symlinks, as mountpoints are listed.
+func mountsUnder(root string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	var mountpoints []string
+	for _, m := range mounts {
+		if m.Mountpoint == root || strings.HasPrefix(m.Mountpoint, root+"/") {
+			mountpoints = append(mountpoints, m.Mountpoint)
+		}
+	}
+	return mountpoints, nil
+}
+
+// mountDiff returns the mountpoints in a which are not in b, counting
+// mountpoints mounted more than once
+func mountDiff(a, b []string) []string {
+	counts := map[string]int{}
+	for _, m := range b {
+		counts[m]++
+	}
+	var diff []string
+	for _, m := range a {
+		if counts[m] > 0 {
+			counts[m]--
+			continue
+		}
+		diff = append(diff, m)
+	}
+	return diff
+}
+
+// forceUnmount unmounts the mountpoints in reverse order, lazily
+// unmounting any mountpoint which is busy
+func forceUnmount(mountpoints []string) error {
+	for i := len(mountpoints) - 1; i >= 0; i-- {
+		if err := mount.ForceUnmount(mountpoints[i]); err != nil {
+			if err := syscall.Unmount(mountpoints[i], syscall.MNT_DETACH); err != nil {
+				return errors.Wrapf(err, "failed to unmount %s", mountpoints[i])
+			}
+		}
+	}
+	return nil
+}
+
+// unmountAll unmounts everything mounted under the root, as done by
+// the daemon on start after a crash
+func unmountAll(root string) error {
+	mountpoints, err := mountsUnder(root)
+	if err != nil {
+		return err
+	}
+	// Unmount the most recent mounts first
+	for i := len(mountpoints) - 1; i >= 0; i-- {
+		if err := mount.Unmount(mountpoints[i]); err != nil {
+			return errors.Wrapf(err, "failed to unmount %s", mountpoints[i])
+		}
+	}
+	return nil
+}
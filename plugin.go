@@ -0,0 +1,147 @@
+package dsdbench
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/docker/pkg/plugins"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/pkg/errors"
+)
+
+// driverPlugin is a graph driver plugin at a fixed address
+type driverPlugin struct {
+	name   string
+	client *plugins.Client
+}
+
+func (p *driverPlugin) Client() *plugins.Client {
+	return p.client
+}
+
+func (p *driverPlugin) Name() string {
+	return p.name
+}
+
+func (p *driverPlugin) BasePath() string {
+	return "/"
+}
+
+func (p *driverPlugin) IsV1() bool {
+	return true
+}
+
+// pluginGetter returns the same plugin for any name since only the
+// configured plugin is ever requested.
+type pluginGetter struct {
+	plugin plugingetter.CompatPlugin
+}
+
+func (pg pluginGetter) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	if capability != "GraphDriver" {
+		return nil, plugins.ErrNotImplements
+	}
+	return pg.plugin, nil
+}
+
+func (pg pluginGetter) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	if capability != "GraphDriver" {
+		return nil, nil
+	}
+	return []plugingetter.CompatPlugin{pg.plugin}, nil
+}
+
+func (pg pluginGetter) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return nil
+}
+
+func (pg pluginGetter) Handle(capability string, callback func(string, *plugins.Client)) {
+}
+
+// pluginName returns the plugin name from the socket or spec
+// file path, the same as plugin discovery.
+func pluginName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// pluginDriverName returns the name a plugin's graph driver is loaded
+// with, prefixed so that a plugin named after a builtin driver, such as
+// overlay2.sock, does not load the builtin driver.
+func pluginDriverName(name string) string {
+	return "plugin:" + name
+}
+
+// loadPlugin loads and activates the graph driver plugin from a unix
+// socket path or a plugin spec file.
+func loadPlugin(path string) (plugingetter.CompatPlugin, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat plugin")
+	}
+
+	var (
+		addr string
+		tls  *tlsconfig.Options
+	)
+	switch {
+	case fi.Mode()&os.ModeSocket != 0:
+		addr = "unix://" + path
+	case filepath.Ext(path) == ".json":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open plugin spec")
+		}
+		defer f.Close()
+
+		var spec struct {
+			Addr      string
+			TLSConfig *tlsconfig.Options
+		}
+		if err := json.NewDecoder(f).Decode(&spec); err != nil {
+			return nil, errors.Wrap(err, "failed to decode plugin spec")
+		}
+		addr = spec.Addr
+		tls = spec.TLSConfig
+		if tls != nil && tls.CAFile == "" {
+			tls.InsecureSkipVerify = true
+		}
+	default:
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read plugin spec")
+		}
+		addr = strings.TrimSpace(string(content))
+	}
+
+	if u, err := url.Parse(addr); err != nil {
+		return nil, errors.Wrapf(err, "invalid plugin address %q", addr)
+	} else if u.Scheme == "" {
+		return nil, errors.Errorf("invalid plugin address %q: missing protocol", addr)
+	}
+
+	client, err := plugins.NewClient(addr, tls)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create plugin client")
+	}
+
+	var m plugins.Manifest
+	if err := client.Call("Plugin.Activate", nil, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to activate plugin")
+	}
+	for _, i := range m.Implements {
+		if i == "GraphDriver" {
+			return &driverPlugin{
+				name:   pluginName(path),
+				client: client,
+			}, nil
+		}
+	}
+
+	return nil, errors.Errorf("plugin %s does not implement GraphDriver", path)
+}
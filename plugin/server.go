@@ -0,0 +1,279 @@
+// Package plugin provides a graph driver plugin server which serves an
+// in-process graph driver over the plugin protocol. The server is used
+// as a stand-in for external plugins to test the plugin proxy.
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+const pluginMimetype = "application/vnd.docker.plugins.v1+json"
+
+type request struct {
+	ID         string            `json:",omitempty"`
+	Parent     string            `json:",omitempty"`
+	MountLabel string            `json:",omitempty"`
+	StorageOpt map[string]string `json:",omitempty"`
+}
+
+type response struct {
+	Err      string            `json:",omitempty"`
+	Dir      string            `json:",omitempty"`
+	Exists   bool              `json:",omitempty"`
+	Status   [][2]string       `json:",omitempty"`
+	Changes  []archive.Change  `json:",omitempty"`
+	Size     int64             `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
+}
+
+type initRequest struct {
+	Home    string
+	Opts    []string        `json:"Opts"`
+	UIDMaps []idtools.IDMap `json:"UIDMaps"`
+	GIDMaps []idtools.IDMap `json:"GIDMaps"`
+}
+
+// Server serves the graph driver plugin protocol for a graph driver
+// registered in this process. The driver is initialized when the
+// plugin client calls init.
+type Server struct {
+	name    string
+	options []string
+	mux     *http.ServeMux
+
+	mu     sync.Mutex
+	driver graphdriver.Driver
+}
+
+// NewServer returns a new plugin server for the named graph driver,
+// the driver options are added to the options given by the client.
+func NewServer(name string, options ...string) *Server {
+	s := &Server{
+		name:    name,
+		options: options,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/Plugin.Activate", s.activate)
+	s.mux.HandleFunc("/GraphDriver.Init", s.init)
+	s.handle("Create", s.create)
+	s.handle("CreateReadWrite", s.createReadWrite)
+	s.handle("Remove", s.remove)
+	s.handle("Get", s.get)
+	s.handle("Put", s.put)
+	s.handle("Exists", s.exists)
+	s.handle("Status", s.status)
+	s.handle("GetMetadata", s.getMetadata)
+	s.handle("Cleanup", s.cleanup)
+	s.handle("Changes", s.changes)
+	s.handle("DiffSize", s.diffSize)
+	s.mux.HandleFunc("/GraphDriver.Diff", s.diff)
+	s.mux.HandleFunc("/GraphDriver.ApplyDiff", s.applyDiff)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Listen serves the plugin protocol on a unix socket at the given path
+// until the returned listener is closed.
+func (s *Server) Listen(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to remove existing socket")
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen")
+	}
+	go http.Serve(l, s)
+	return l, nil
+}
+
+func (s *Server) getDriver() (graphdriver.Driver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.driver == nil {
+		return nil, errors.New("driver not initialized")
+	}
+	return s.driver, nil
+}
+
+// handle registers a graph driver method which takes a request and
+// fills in the response.
+func (s *Server) handle(method string, f func(graphdriver.Driver, request, *response) error) {
+	s.mux.HandleFunc("/GraphDriver."+method, func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, errors.Wrap(err, "failed to decode request"))
+			return
+		}
+		d, err := s.getDriver()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var resp response
+		if err := f(d, req, &resp); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResponse(w, http.StatusOK, resp)
+	})
+}
+
+func writeResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", pluginMimetype)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeResponse(w, http.StatusInternalServerError, response{Err: err.Error()})
+}
+
+func (s *Server) activate(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, map[string][]string{
+		"Implements": {"GraphDriver"},
+	})
+}
+
+func (s *Server) init(w http.ResponseWriter, r *http.Request) {
+	var req initRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errors.Wrap(err, "failed to decode request"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.driver != nil {
+		writeError(w, errors.New("driver already initialized"))
+		return
+	}
+	if err := os.MkdirAll(req.Home, 0700); err != nil {
+		writeError(w, errors.Wrap(err, "failed to create plugin home"))
+		return
+	}
+	d, err := graphdriver.GetDriver(s.name, nil, graphdriver.Options{
+		Root:          req.Home,
+		DriverOptions: append(append([]string{}, s.options...), req.Opts...),
+		UIDMaps:       req.UIDMaps,
+		GIDMaps:       req.GIDMaps,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.driver = d
+	writeResponse(w, http.StatusOK, response{})
+}
+
+func createOpts(req request) *graphdriver.CreateOpts {
+	return &graphdriver.CreateOpts{
+		MountLabel: req.MountLabel,
+		StorageOpt: req.StorageOpt,
+	}
+}
+
+func (s *Server) create(d graphdriver.Driver, req request, resp *response) error {
+	return d.Create(req.ID, req.Parent, createOpts(req))
+}
+
+func (s *Server) createReadWrite(d graphdriver.Driver, req request, resp *response) error {
+	return d.CreateReadWrite(req.ID, req.Parent, createOpts(req))
+}
+
+func (s *Server) remove(d graphdriver.Driver, req request, resp *response) error {
+	return d.Remove(req.ID)
+}
+
+func (s *Server) get(d graphdriver.Driver, req request, resp *response) (err error) {
+	resp.Dir, err = d.Get(req.ID, req.MountLabel)
+	return
+}
+
+func (s *Server) put(d graphdriver.Driver, req request, resp *response) error {
+	return d.Put(req.ID)
+}
+
+func (s *Server) exists(d graphdriver.Driver, req request, resp *response) error {
+	resp.Exists = d.Exists(req.ID)
+	return nil
+}
+
+func (s *Server) status(d graphdriver.Driver, req request, resp *response) error {
+	resp.Status = d.Status()
+	return nil
+}
+
+func (s *Server) getMetadata(d graphdriver.Driver, req request, resp *response) (err error) {
+	resp.Metadata, err = d.GetMetadata(req.ID)
+	return
+}
+
+// cleanup cleans up the driver, the driver may then be initialized again
+func (s *Server) cleanup(d graphdriver.Driver, req request, resp *response) error {
+	s.mu.Lock()
+	s.driver = nil
+	s.mu.Unlock()
+	return d.Cleanup()
+}
+
+func (s *Server) changes(d graphdriver.Driver, req request, resp *response) (err error) {
+	resp.Changes, err = d.Changes(req.ID, req.Parent)
+	return
+}
+
+func (s *Server) diffSize(d graphdriver.Driver, req request, resp *response) (err error) {
+	resp.Size, err = d.DiffSize(req.ID, req.Parent)
+	return
+}
+
+func (s *Server) diff(w http.ResponseWriter, r *http.Request) {
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errors.Wrap(err, "failed to decode request"))
+		return
+	}
+	d, err := s.getDriver()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rc, err := d.Diff(req.ID, req.Parent)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	io.Copy(w, rc)
+}
+
+func (s *Server) applyDiff(w http.ResponseWriter, r *http.Request) {
+	d, err := s.getDriver()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	size, err := d.ApplyDiff(q.Get("id"), q.Get("parent"), r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, response{Size: size})
+}
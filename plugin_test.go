@@ -0,0 +1,57 @@
+package dsdbench
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dmcgowan/dsdbench/plugin"
+)
+
+// TestPlugin serves the reference driver as a plugin on a socket named
+// after the builtin driver and runs a layer test over the socket.
+func TestPlugin(t *testing.T) {
+	td, err := ioutil.TempDir(config.Root, "plugin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	l, err := net.Listen("unix", filepath.Join(td, "reference.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var (
+		mu    sync.Mutex
+		calls = map[string]int{}
+	)
+	s := plugin.NewServer("reference")
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		s.ServeHTTP(w, r)
+	}))
+
+	defer Configure(config)
+	Configure(Config{
+		Plugin: l.Addr().String(),
+		Root:   config.Root,
+	})
+
+	testLayerCreate(t)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, method := range []string{"/GraphDriver.Init", "/GraphDriver.ApplyDiff", "/GraphDriver.Get"} {
+		if calls[method] == 0 {
+			t.Errorf("%s not called over the plugin socket", method)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package dsdbench
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	registerTests(
+		Test{Name: "Posix", F: testPosix},
+	)
+}
+
+// posixCase is a file system operation in the style of pjdfstest. The
+// files from posixSetup are created in the case's directory in a lower
+// layer and the case is run in the same directory of a mounted
+// read-write layer.
+// The results describe the errors returned and the resulting state, the
+// results are compared with running the case in a plain directory.
+type posixCase struct {
+	name string
+	run  func(d posixDir) []string
+}
+
+// posixDir is the directory a case is run in
+type posixDir string
+
+func (d posixDir) path(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+// errnoNames are the names of the errors expected from the cases
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:      "EPERM",
+	syscall.ENOENT:     "ENOENT",
+	syscall.EBADF:      "EBADF",
+	syscall.EACCES:     "EACCES",
+	syscall.EBUSY:      "EBUSY",
+	syscall.EEXIST:     "EEXIST",
+	syscall.EXDEV:      "EXDEV",
+	syscall.ENOTDIR:    "ENOTDIR",
+	syscall.EISDIR:     "EISDIR",
+	syscall.EINVAL:     "EINVAL",
+	syscall.EMLINK:     "EMLINK",
+	syscall.EROFS:      "EROFS",
+	syscall.ELOOP:      "ELOOP",
+	syscall.ENOTEMPTY:  "ENOTEMPTY",
+	syscall.EOPNOTSUPP: "EOPNOTSUPP",
+}
+
+// errResult returns "ok" or the name of the error number
+func errResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		if name, ok := errnoNames[errno]; ok {
+			return name
+		}
+		return fmt.Sprintf("errno %d", errno)
+	}
+	return err.Error()
+}
+
+// stat describes the file without following symlinks. The size and
+// link count of directories depend on the file system and are left out.
+func (d posixDir) stat(name string) string {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(d.path(name), &st); err != nil {
+		return errResult(err)
+	}
+	desc := fmt.Sprintf("mode=%06o uid=%d gid=%d", st.Mode, st.Uid, st.Gid)
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		desc = fmt.Sprintf("%s size=%d nlink=%d", desc, st.Size, st.Nlink)
+	}
+	return desc
+}
+
+// times returns the access and modification times of the file
+func (d posixDir) times(name string) string {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(d.path(name), &st); err != nil {
+		return errResult(err)
+	}
+	return fmt.Sprintf("atime=%d.%09d mtime=%d.%09d", st.Atim.Sec, st.Atim.Nsec, st.Mtim.Sec, st.Mtim.Nsec)
+}
+
+// read returns the content of the file
+func (d posixDir) read(name string) string {
+	b, err := ioutil.ReadFile(d.path(name))
+	if err != nil {
+		return errResult(err)
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+// list returns the sorted names in the directory
+func (d posixDir) list(name string) string {
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return errResult(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return errResult(err)
+	}
+	sort.Strings(names)
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+func (d posixDir) open(name string, flag int, perm os.FileMode) string {
+	f, err := os.OpenFile(d.path(name), flag, perm)
+	if err != nil {
+		return errResult(err)
+	}
+	return errResult(f.Close())
+}
+
+func (d posixDir) write(name string, flag int, content string) string {
+	f, err := os.OpenFile(d.path(name), flag, 0644)
+	if err != nil {
+		return errResult(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return errResult(err)
+	}
+	return errResult(f.Close())
+}
+
+func (d posixDir) utimes(name string, atime, mtime int64) string {
+	ts := []syscall.Timespec{
+		syscall.NsecToTimespec(atime),
+		syscall.NsecToTimespec(mtime),
+	}
+	return errResult(syscall.UtimesNano(d.path(name), ts))
+}
+
+// posixSetup returns the common lower layer files for a case
+func posixSetup() []ApplyFile {
+	return []ApplyFile{
+		NewTestFile("/f", []byte("hello"), 0644),
+		CreateDirectory("/d", 0755),
+		CreateDirectory("/full", 0755),
+		NewTestFile("/full/f1", []byte("1"), 0644),
+		CreateDirectory("/full/sub", 0755),
+		NewTestFile("/full/sub/f2", []byte("2"), 0644),
+		Symlink("f", "/l"),
+		Symlink("missing", "/dangling"),
+	}
+}
+
+var posixCases = []posixCase{
+	// open and creat
+	{name: "OpenExclusiveExisting", run: func(d posixDir) []string {
+		return []string{d.open("f", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)}
+	}},
+	{name: "OpenExclusiveSymlink", run: func(d posixDir) []string {
+		return []string{d.open("dangling", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644), d.stat("missing")}
+	}},
+	{name: "OpenMissing", run: func(d posixDir) []string {
+		return []string{d.open("missing", os.O_RDONLY, 0)}
+	}},
+	{name: "OpenNotDirectory", run: func(d posixDir) []string {
+		return []string{d.open("f/x", os.O_RDONLY, 0), d.open("f/x", os.O_CREATE|os.O_WRONLY, 0644)}
+	}},
+	{name: "OpenDirectoryWrite", run: func(d posixDir) []string {
+		return []string{d.open("d", os.O_WRONLY, 0), d.open("d", os.O_RDWR, 0)}
+	}},
+	{name: "OpenDirectoryFlag", run: func(d posixDir) []string {
+		return []string{d.open("f", os.O_RDONLY|syscall.O_DIRECTORY, 0), d.open("d", os.O_RDONLY|syscall.O_DIRECTORY, 0)}
+	}},
+	{name: "OpenNoFollow", run: func(d posixDir) []string {
+		return []string{d.open("l", os.O_RDONLY|syscall.O_NOFOLLOW, 0)}
+	}},
+	{name: "OpenTruncate", run: func(d posixDir) []string {
+		return []string{d.open("f", os.O_WRONLY|os.O_TRUNC, 0), d.stat("f"), d.read("f")}
+	}},
+	{name: "OpenAppend", run: func(d posixDir) []string {
+		return []string{d.write("f", os.O_WRONLY|os.O_APPEND, "!"), d.read("f")}
+	}},
+	{name: "OpenReadOnlyUnchanged", run: func(d posixDir) []string {
+		return []string{d.open("f", os.O_RDONLY, 0), d.stat("f"), d.read("f")}
+	}},
+	{name: "OpenThroughSymlink", run: func(d posixDir) []string {
+		return []string{d.write("l", os.O_WRONLY|os.O_TRUNC, "link"), d.read("f"), d.stat("l")}
+	}},
+	{name: "CreatNew", run: func(d posixDir) []string {
+		return []string{d.open("new", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640), d.stat("new")}
+	}},
+	{name: "CreatExisting", run: func(d posixDir) []string {
+		return []string{d.open("f", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600), d.stat("f")}
+	}},
+	{name: "CreatRemovedParent", run: func(d posixDir) []string {
+		return []string{errResult(os.RemoveAll(d.path("full"))), d.open("full/f1", os.O_CREATE|os.O_WRONLY, 0644)}
+	}},
+
+	// unlink
+	{name: "UnlinkFile", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Unlink(d.path("f"))), d.stat("f"), d.stat("l")}
+	}},
+	{name: "UnlinkDirectory", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Unlink(d.path("d"))), d.stat("d")}
+	}},
+	{name: "UnlinkMissing", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Unlink(d.path("missing")))}
+	}},
+	{name: "UnlinkSymlink", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Unlink(d.path("l"))), d.stat("l"), d.read("f")}
+	}},
+	{name: "UnlinkRecreate", run: func(d posixDir) []string {
+		return []string{
+			errResult(syscall.Unlink(d.path("f"))),
+			d.write("f", os.O_CREATE|os.O_EXCL|os.O_WRONLY, "new"),
+			d.read("f"),
+			d.list(""),
+		}
+	}},
+	{name: "UnlinkOpenFile", run: func(d posixDir) []string {
+		f, err := os.Open(d.path("f"))
+		if err != nil {
+			return []string{errResult(err)}
+		}
+		defer f.Close()
+		results := []string{errResult(syscall.Unlink(d.path("f"))), d.stat("f")}
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return append(results, errResult(err))
+		}
+		return append(results, fmt.Sprintf("%q", b))
+	}},
+
+	// rename
+	{name: "RenameFile", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("f"), d.path("g"))), d.stat("f"), d.read("g")}
+	}},
+	{name: "RenameOverFile", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("full/f1"), d.path("f"))), d.read("f"), d.list("full")}
+	}},
+	{name: "RenameIntoDirectory", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("f"), d.path("d/f"))), d.read("d/f"), d.list("")}
+	}},
+	{name: "RenameDirectory", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("full"), d.path("moved"))), d.list("moved"), d.read("moved/sub/f2")}
+	}},
+	{name: "RenameDirectoryOverEmpty", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("full"), d.path("d"))), d.list("d")}
+	}},
+	{name: "RenameDirectoryOverNonEmpty", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("d"), d.path("full"))), d.list("full")}
+	}},
+	{name: "RenameDirectoryOverFile", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("d"), d.path("f"))), d.stat("f")}
+	}},
+	{name: "RenameFileOverDirectory", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("f"), d.path("d"))), d.stat("f")}
+	}},
+	{name: "RenameDirectoryIntoItself", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("full"), d.path("full/sub/full")))}
+	}},
+	{name: "RenameSame", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("f"), d.path("f"))), d.read("f")}
+	}},
+	{name: "RenameSymlink", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("l"), d.path("d/l"))), d.read("d/l"), d.stat("f")}
+	}},
+	{name: "RenameMissing", run: func(d posixDir) []string {
+		return []string{errResult(os.Rename(d.path("missing"), d.path("g")))}
+	}},
+
+	// link
+	{name: "LinkFile", run: func(d posixDir) []string {
+		return []string{errResult(os.Link(d.path("f"), d.path("g"))), d.stat("f"), d.stat("g")}
+	}},
+	{name: "LinkUpdate", run: func(d posixDir) []string {
+		return []string{
+			errResult(os.Link(d.path("f"), d.path("g"))),
+			d.write("g", os.O_WRONLY|os.O_APPEND, "!"),
+			d.read("f"),
+		}
+	}},
+	{name: "LinkExisting", run: func(d posixDir) []string {
+		return []string{errResult(os.Link(d.path("f"), d.path("full/f1"))), d.read("full/f1")}
+	}},
+	{name: "LinkDirectory", run: func(d posixDir) []string {
+		return []string{errResult(os.Link(d.path("d"), d.path("e")))}
+	}},
+	{name: "LinkRemoveOriginal", run: func(d posixDir) []string {
+		return []string{
+			errResult(os.Link(d.path("f"), d.path("g"))),
+			errResult(os.Remove(d.path("f"))),
+			d.stat("g"),
+			d.read("g"),
+		}
+	}},
+
+	// symlink
+	{name: "SymlinkCreate", run: func(d posixDir) []string {
+		results := []string{errResult(os.Symlink("../f", d.path("d/l"))), d.read("d/l")}
+		target, err := os.Readlink(d.path("d/l"))
+		if err != nil {
+			return append(results, errResult(err))
+		}
+		return append(results, target)
+	}},
+	{name: "SymlinkExisting", run: func(d posixDir) []string {
+		return []string{errResult(os.Symlink("f", d.path("l"))), errResult(os.Symlink("f", d.path("d")))}
+	}},
+	{name: "SymlinkDangling", run: func(d posixDir) []string {
+		_, err := os.Stat(d.path("dangling"))
+		return []string{errResult(err), d.stat("dangling"), d.read("dangling")}
+	}},
+	{name: "SymlinkReplace", run: func(d posixDir) []string {
+		return []string{
+			errResult(os.Remove(d.path("l"))),
+			errResult(os.Symlink("full/f1", d.path("l"))),
+			d.read("l"),
+		}
+	}},
+
+	// mkdir
+	{name: "MkdirExisting", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Mkdir(d.path("d"), 0755)), errResult(syscall.Mkdir(d.path("f"), 0755))}
+	}},
+	{name: "MkdirMissingParent", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Mkdir(d.path("missing/d"), 0755))}
+	}},
+	{name: "MkdirNotDirectory", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Mkdir(d.path("f/d"), 0755))}
+	}},
+	{name: "MkdirMode", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Mkdir(d.path("d/new"), 0750)), d.stat("d/new")}
+	}},
+	{name: "MkdirAfterRemove", run: func(d posixDir) []string {
+		return []string{
+			errResult(os.RemoveAll(d.path("full"))),
+			errResult(syscall.Mkdir(d.path("full"), 0700)),
+			d.stat("full"),
+			d.list("full"),
+		}
+	}},
+
+	// rmdir
+	{name: "RmdirEmpty", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Rmdir(d.path("d"))), d.stat("d")}
+	}},
+	{name: "RmdirNonEmpty", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Rmdir(d.path("full"))), d.list("full")}
+	}},
+	{name: "RmdirAfterRemovingChildren", run: func(d posixDir) []string {
+		return []string{
+			errResult(os.Remove(d.path("full/sub/f2"))),
+			errResult(syscall.Rmdir(d.path("full/sub"))),
+			errResult(os.Remove(d.path("full/f1"))),
+			d.list("full"),
+			errResult(syscall.Rmdir(d.path("full"))),
+			d.list(""),
+		}
+	}},
+	{name: "RmdirFile", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Rmdir(d.path("f")))}
+	}},
+	{name: "RmdirDot", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Rmdir(d.path("d") + "/."))}
+	}},
+	{name: "RmdirSymlink", run: func(d posixDir) []string {
+		return []string{errResult(os.Symlink("d", d.path("ld"))), errResult(syscall.Rmdir(d.path("ld")))}
+	}},
+
+	// chmod
+	{name: "ChmodFile", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Chmod(d.path("f"), 0600)), d.stat("f"), d.read("f")}
+	}},
+	{name: "ChmodDirectory", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Chmod(d.path("full"), 0700)), d.stat("full"), d.list("full")}
+	}},
+	{name: "ChmodSpecialBits", run: func(d posixDir) []string {
+		return []string{
+			errResult(syscall.Chmod(d.path("f"), syscall.S_ISUID|syscall.S_ISGID|0755)),
+			d.stat("f"),
+			errResult(syscall.Chmod(d.path("d"), syscall.S_ISVTX|0777)),
+			d.stat("d"),
+		}
+	}},
+	{name: "ChmodSymlink", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Chmod(d.path("l"), 0600)), d.stat("f")}
+	}},
+	{name: "ChmodMissing", run: func(d posixDir) []string {
+		return []string{errResult(syscall.Chmod(d.path("missing"), 0600)), errResult(syscall.Chmod(d.path("dangling"), 0600))}
+	}},
+
+	// chown
+	{name: "ChownFile", run: func(d posixDir) []string {
+		return []string{errResult(os.Lchown(d.path("f"), 1, 1)), d.stat("f"), d.read("f")}
+	}},
+	{name: "ChownDirectory", run: func(d posixDir) []string {
+		return []string{errResult(os.Lchown(d.path("full"), 1, 1)), d.stat("full"), d.stat("full/f1")}
+	}},
+	{name: "ChownSymlink", run: func(d posixDir) []string {
+		return []string{errResult(os.Lchown(d.path("l"), 1, 1)), d.stat("l"), d.stat("f")}
+	}},
+	{name: "ChownFollowSymlink", run: func(d posixDir) []string {
+		return []string{errResult(os.Chown(d.path("l"), 1, 1)), d.stat("l"), d.stat("f")}
+	}},
+	{name: "ChownUnchanged", run: func(d posixDir) []string {
+		return []string{errResult(os.Lchown(d.path("f"), -1, -1)), d.stat("f")}
+	}},
+	{name: "ChownClearsSetuid", run: func(d posixDir) []string {
+		return []string{
+			errResult(syscall.Chmod(d.path("f"), syscall.S_ISUID|syscall.S_ISGID|0755)),
+			errResult(os.Lchown(d.path("f"), os.Geteuid(), os.Getegid())),
+			d.stat("f"),
+		}
+	}},
+
+	// truncate
+	{name: "TruncateShrink", run: func(d posixDir) []string {
+		return []string{errResult(os.Truncate(d.path("f"), 2)), d.stat("f"), d.read("f")}
+	}},
+	{name: "TruncateGrow", run: func(d posixDir) []string {
+		return []string{errResult(os.Truncate(d.path("f"), 8)), d.stat("f"), d.read("f")}
+	}},
+	{name: "TruncateZero", run: func(d posixDir) []string {
+		return []string{errResult(os.Truncate(d.path("f"), 0)), d.stat("f"), d.read("f")}
+	}},
+	{name: "TruncateDirectory", run: func(d posixDir) []string {
+		return []string{errResult(os.Truncate(d.path("d"), 0))}
+	}},
+	{name: "TruncateNegative", run: func(d posixDir) []string {
+		return []string{errResult(os.Truncate(d.path("f"), -1)), d.read("f")}
+	}},
+	{name: "TruncateOpenFile", run: func(d posixDir) []string {
+		f, err := os.OpenFile(d.path("f"), os.O_RDWR, 0)
+		if err != nil {
+			return []string{errResult(err)}
+		}
+		defer f.Close()
+		return []string{errResult(f.Truncate(3)), d.read("f")}
+	}},
+
+	// utimens
+	{name: "UtimensFile", run: func(d posixDir) []string {
+		return []string{d.utimes("f", 1000000000123456789, 1100000000987654321), d.times("f"), d.read("f")}
+	}},
+	{name: "UtimensDirectory", run: func(d posixDir) []string {
+		return []string{d.utimes("full", 1000000000000000000, 1100000000000000000), d.times("full"), d.list("full")}
+	}},
+	{name: "UtimensSymlink", run: func(d posixDir) []string {
+		return []string{d.utimes("l", 1000000000000000000, 1100000000000000000), d.times("f")}
+	}},
+	{name: "UtimensMissing", run: func(d posixDir) []string {
+		return []string{d.utimes("missing", 0, 0)}
+	}},
+	{name: "UtimensPreservedOnChmod", run: func(d posixDir) []string {
+		return []string{
+			d.utimes("f", 1000000000000000000, 1100000000000000000),
+			errResult(syscall.Chmod(d.path("f"), 0600)),
+			d.times("f"),
+		}
+	}},
+}
+
+// posixInit creates a directory for each case with the setup files
+func posixInit(cases []posixCase) LayerInit {
+	return func(root string) error {
+		for _, c := range cases {
+			dir := filepath.Join(root, c.name)
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+			for _, f := range posixSetup() {
+				if err := f(dir); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// runPosixCases runs every case in the root and returns the results
+func runPosixCases(root string, cases []posixCase) map[string]string {
+	results := map[string]string{}
+	for _, c := range cases {
+		results[c.name] = strings.Join(c.run(posixDir(filepath.Join(root, c.name))), "; ")
+	}
+	return results
+}
+
+// testPosix runs the POSIX cases in a mounted read-write layer and in
+// a plain directory, only the cases where the layer differs from the
+// plain directory are reported. The plain directory is created under
+// the root directory so it is on the same filesystem the driver uses.
+func testPosix(t T) {
+	baseline, err := ioutil.TempDir(config.Root, "posix-baseline-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseline)
+
+	setup := posixInit(posixCases)
+	if err := setup(baseline); err != nil {
+		t.Fatalf("Failed to create baseline: %+v", err)
+	}
+	expected := runPosixCases(baseline, posixCases)
+
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	l, err := CreateLayer(ls, "", setup)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l)
+
+	_, p, release := mountRWLayer(t, ls, l.ChainID())
+	defer release()
+
+	actual := runPosixCases(p, posixCases)
+
+	var deviations int
+	for _, c := range posixCases {
+		if actual[c.name] != expected[c.name] {
+			t.Errorf("%s: %s, baseline %s", c.name, actual[c.name], expected[c.name])
+			deviations++
+		}
+	}
+	t.Logf("%d of %d cases deviate from baseline", deviations, len(posixCases))
+}
@@ -0,0 +1,300 @@
+package dsdbench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/pkg/errors"
+)
+
+const (
+	processPrefix = "dsdbench-process-"
+
+	// processTimeout is the time to wait for a result from a helper
+	// process before giving up on it
+	processTimeout = 30 * time.Second
+)
+
+// ProcessFunc is a helper function run in a separate process inside a
+// mounted layer. When run as root the process is chrooted into the
+// layer, otherwise only the working directory is changed to the root of
+// the layer, so the function should use paths relative to the working
+// directory. Files opened by the function stay open until it returns.
+type ProcessFunc func(p *ProcessContext, args []string) error
+
+// registerProcess registers a helper function which can be started in
+// a mounted layer using StartProcess.
+func registerProcess(name string, f ProcessFunc) {
+	reexec.Register(processPrefix+name, func() {
+		runProcess(f)
+	})
+}
+
+type processMessage struct {
+	Result string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	Done   bool   `json:",omitempty"`
+}
+
+// ProcessContext is used by a helper function to report results to
+// and wait on the test which started it.
+type ProcessContext struct {
+	results *json.Encoder
+	control *bufio.Reader
+}
+
+// Report sends a result to the test
+func (p *ProcessContext) Report(format string, args ...interface{}) error {
+	return p.results.Encode(processMessage{Result: fmt.Sprintf(format, args...)})
+}
+
+// Wait waits until the test continues the process
+func (p *ProcessContext) Wait() error {
+	if _, err := p.control.ReadString('\n'); err != nil {
+		return errors.Wrap(err, "failed to wait for test")
+	}
+	return nil
+}
+
+// runProcess is run in the helper process, the arguments are the mode
+// and root followed by the arguments to the helper function. Results
+// are written to the pipe at file descriptor 3 and the test continues
+// the process by writing lines to standard input.
+func runProcess(f ProcessFunc) {
+	results := json.NewEncoder(os.NewFile(3, "results"))
+	p := &ProcessContext{
+		results: results,
+		control: bufio.NewReader(os.Stdin),
+	}
+
+	var err error
+	if len(os.Args) < 3 {
+		err = errors.New("missing process root")
+	} else if err = enterRoot(os.Args[1], os.Args[2]); err == nil {
+		err = f(p, os.Args[3:])
+	}
+
+	if err != nil {
+		results.Encode(processMessage{Error: err.Error(), Done: true})
+		os.Exit(1)
+	}
+	results.Encode(processMessage{Done: true})
+	os.Exit(0)
+}
+
+func enterRoot(mode, root string) error {
+	if mode == "chroot" {
+		if err := syscall.Chroot(root); err != nil {
+			return errors.Wrap(err, "failed to chroot")
+		}
+		root = "/"
+	}
+	if err := os.Chdir(root); err != nil {
+		return errors.Wrap(err, "failed to change directory")
+	}
+	return nil
+}
+
+// lockedBuffer is a buffer which may be read while the standard error
+// of a running process is written to it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Process is a helper process running inside a mounted layer
+type Process struct {
+	name    string
+	root    string
+	cmd     *exec.Cmd
+	control io.WriteCloser
+	results chan processMessage
+	stderr  *lockedBuffer
+	exited  bool
+	err     error
+}
+
+// StartProcess starts the registered helper function in the mounted
+// layer at root. The process must be closed before the layer is
+// unmounted.
+func StartProcess(root, name string, args ...string) (*Process, error) {
+	mode := "chdir"
+	if os.Geteuid() == 0 {
+		mode = "chroot"
+	}
+	processRoot := root
+	if mode == "chroot" {
+		processRoot = "/"
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	cmd := reexec.Command(append([]string{processPrefix + name, mode, root}, args...)...)
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	cmd.ExtraFiles = []*os.File{w}
+	stderr := &lockedBuffer{}
+	cmd.Stderr = stderr
+
+	control, err := cmd.StdinPipe()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		control.Close()
+		return nil, errors.Wrapf(err, "failed to start %s", name)
+	}
+
+	p := &Process{
+		name:    name,
+		root:    processRoot,
+		cmd:     cmd,
+		control: control,
+		results: make(chan processMessage, 1),
+		stderr:  stderr,
+	}
+
+	go func() {
+		defer r.Close()
+		defer close(p.results)
+		dec := json.NewDecoder(r)
+		for {
+			var msg processMessage
+			if err := dec.Decode(&msg); err != nil {
+				return
+			}
+			p.results <- msg
+			if msg.Done {
+				return
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// Path returns the absolute path in the layer as seen by the process
+func (p *Process) Path(path string) string {
+	return filepath.Join(p.root, path)
+}
+
+// next returns the next message from the process
+func (p *Process) next() (processMessage, error) {
+	if p.exited {
+		return processMessage{}, errors.Errorf("%s exited", p.name)
+	}
+	select {
+	case msg, ok := <-p.results:
+		if !ok {
+			p.exited = true
+			return processMessage{}, errors.Errorf("%s exited without result: %s", p.name, strings.TrimSpace(p.stderr.String()))
+		}
+		if msg.Done {
+			p.exited = true
+			if msg.Error != "" {
+				p.err = errors.Errorf("%s failed: %s", p.name, msg.Error)
+			}
+		}
+		return msg, nil
+	case <-time.After(processTimeout):
+		return processMessage{}, errors.Errorf("timed out waiting for %s", p.name)
+	}
+}
+
+// Result returns the next result reported by the process
+func (p *Process) Result() (string, error) {
+	msg, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if msg.Done {
+		if p.err != nil {
+			return "", p.err
+		}
+		return "", errors.Errorf("%s exited without result", p.name)
+	}
+	return msg.Result, nil
+}
+
+// Continue continues a process waiting on the test
+func (p *Process) Continue() error {
+	if _, err := io.WriteString(p.control, "\n"); err != nil {
+		return errors.Wrapf(err, "failed to continue %s", p.name)
+	}
+	return nil
+}
+
+// Wait waits for the process to exit and returns the error from the
+// helper function, any results not yet read are discarded.
+func (p *Process) Wait() error {
+	for !p.exited {
+		if _, err := p.next(); err != nil {
+			p.Close()
+			return err
+		}
+	}
+	p.control.Close()
+	for range p.results {
+	}
+	if err := p.cmd.Wait(); err != nil && p.err == nil {
+		p.err = errors.Wrapf(err, "%s failed: %s", p.name, strings.TrimSpace(p.stderr.String()))
+	}
+	return p.err
+}
+
+// Close kills the process if it is still running and waits for it to
+// exit, releasing any files it holds open in the layer.
+func (p *Process) Close() error {
+	if p.cmd.ProcessState != nil {
+		return nil
+	}
+	p.control.Close()
+	p.cmd.Process.Kill()
+	for range p.results {
+	}
+	p.cmd.Wait()
+	return nil
+}
+
+// checkResults checks the next results reported by the process
+func checkResults(t T, p *Process, stage string, expected ...string) {
+	for _, e := range expected {
+		result, err := p.Result()
+		if err != nil {
+			t.Fatalf("%s: %v", stage, err)
+		}
+		if result != e {
+			issueFound(t)
+			t.Errorf("%s: unexpected result %q, expected %q", stage, result, e)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package dsdbench
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	registerBenchmarks(
+		Benchmark{Name: "RegisterSmallFiles", F: benchmarkRegisterSmallFiles},
+		Benchmark{Name: "RegisterMixedFiles", F: benchmarkRegisterMixedFiles},
+		Benchmark{Name: "RegisterLargeFiles", F: benchmarkRegisterLargeFiles, Large: true},
+	)
+}
+
+// SizeDistribution is how the total size of a generated tar is
+// divided between its files
+type SizeDistribution int
+
+const (
+	// EqualSizes gives every file the same size
+	EqualSizes SizeDistribution = iota
+
+	// UniformSizes gives files uniformly distributed sizes
+	UniformSizes
+
+	// ExponentialSizes gives many small files and a few large files,
+	// as in most images
+	ExponentialSizes
+)
+
+// filesPerDir is the number of files in each directory of a generated
+// tar, directories are nested two deep.
+const filesPerDir = 100
+
+// TarOptions configure the layer tar created by GenerateTar
+type TarOptions struct {
+	// Seed seeds the file sizes and content, the same options always
+	// generate the same tar for the same user
+	Seed int64
+
+	// Files is the number of regular files
+	Files int
+
+	// Size is the total size of the file content
+	Size int64
+
+	// Distribution is how the size is divided between the files
+	Distribution SizeDistribution
+
+	// Depth is the number of directories the generated directories
+	// are nested in, for deep trees
+	Depth int
+}
+
+// fileSizes returns the size of each file, adding up to the total size
+func (o TarOptions) fileSizes(r *rand.Rand) []int64 {
+	weights := make([]float64, o.Files)
+	var sum float64
+	for i := range weights {
+		switch o.Distribution {
+		case UniformSizes:
+			weights[i] = r.Float64()
+		case ExponentialSizes:
+			weights[i] = r.ExpFloat64()
+		default:
+			weights[i] = 1
+		}
+		sum += weights[i]
+	}
+
+	sizes := make([]int64, o.Files)
+	remaining := o.Size
+	for i, w := range weights {
+		if i == len(weights)-1 {
+			sizes[i] = remaining
+			break
+		}
+		sizes[i] = int64(float64(o.Size) * w / sum)
+		if sizes[i] > remaining {
+			sizes[i] = remaining
+		}
+		remaining -= sizes[i]
+	}
+	return sizes
+}
+
+// generatedPath returns the path of a file in a generated tar with no
+// depth
+func generatedPath(i int) string {
+	return fmt.Sprintf("d%d/d%d/f%d", i/(filesPerDir*filesPerDir), i/filesPerDir%filesPerDir, i)
+}
+
+// GenerateTar writes an uncompressed layer tar with the configured
+// number of files and total size. File content is pseudo-random so the
+// tar does not benefit from compression or deduplication. Files are
+// owned by the current user so the tar may be registered by
+// unprivileged drivers.
+func GenerateTar(w io.Writer, opts TarOptions) error {
+	if opts.Files < 1 {
+		return errors.New("tar must have at least one file")
+	}
+	r := rand.New(rand.NewSource(opts.Seed))
+	sizes := opts.fileSizes(r)
+
+	modTime := time.Unix(opts.Seed, 0)
+	uid, gid := os.Getuid(), os.Getgid()
+	tw := tar.NewWriter(w)
+
+	writeDir := func(name string) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     name + "/",
+			Mode:     0755,
+			Uid:      uid,
+			Gid:      gid,
+			ModTime:  modTime,
+		})
+	}
+
+	var prefix string
+	for i := 0; i < opts.Depth; i++ {
+		prefix = path.Join(prefix, fmt.Sprintf("n%d", i))
+		if err := writeDir(prefix); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 1<<20)
+	var top, dir string
+	for i, size := range sizes {
+		name := path.Join(prefix, generatedPath(i))
+		if t := path.Dir(path.Dir(name)); t != top {
+			top = t
+			if err := writeDir(top); err != nil {
+				return err
+			}
+		}
+		if d := path.Dir(name); d != dir {
+			dir = d
+			if err := writeDir(dir); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Uid:      uid,
+			Gid:      gid,
+			Size:     size,
+			ModTime:  modTime,
+		}); err != nil {
+			return err
+		}
+		for size > 0 {
+			n := int64(len(buf))
+			if size < n {
+				n = size
+			}
+			r.Read(buf[:n])
+			if _, err := tw.Write(buf[:n]); err != nil {
+				return err
+			}
+			size -= n
+		}
+	}
+
+	return tw.Close()
+}
+
+func benchmarkRegisterSmallFiles(b *testing.B) {
+	benchmarkRegister(b, TarOptions{
+		Seed:         1,
+		Files:        10000,
+		Size:         40 << 20,
+		Distribution: EqualSizes,
+	})
+}
+
+func benchmarkRegisterMixedFiles(b *testing.B) {
+	benchmarkRegister(b, TarOptions{
+		Seed:         1,
+		Files:        2000,
+		Size:         128 << 20,
+		Distribution: ExponentialSizes,
+	})
+}
+
+func benchmarkRegisterLargeFiles(b *testing.B) {
+	benchmarkRegister(b, TarOptions{
+		Seed:         1,
+		Files:        4,
+		Size:         256 << 20,
+		Distribution: UniformSizes,
+	})
+}
+
+// benchmarkRegister times registering a generated tar, the tar is
+// written to a file before the benchmark so generating it is not
+// timed. Throughput is reported in bytes of tar and files per second.
+func benchmarkRegister(b *testing.B, opts TarOptions) {
+	b.StopTimer()
+	ls, err := getLayerStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup(b, ls)
+
+	f, err := ioutil.TempFile("", "register-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	digester := digest.Canonical.Digester()
+	if err := GenerateTar(io.MultiWriter(f, digester.Hash()), opts); err != nil {
+		b.Fatalf("Failed to generate tar: %v", err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		b.Fatal(err)
+	}
+	diffID := layer.DiffID(digester.Digest())
+
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		l, err := ls.Register(f, "")
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("Failed to register new layer: %+v", err)
+		}
+		if l.DiffID() != diffID {
+			b.Fatalf("unexpected diff id %s, expected %s", l.DiffID(), diffID)
+		}
+		if _, err := ls.Release(l); err != nil {
+			b.Fatalf("Failed to release layer: %+v", err)
+		}
+	}
+
+	if elapsed := b.Elapsed(); elapsed > 0 {
+		b.ReportMetric(float64(opts.Files)*float64(b.N)/elapsed.Seconds(), "files/s")
+	}
+}
@@ -0,0 +1,76 @@
+package dsdbench
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestGenerateTar(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts TarOptions
+	}{
+		{"EqualSizes", TarOptions{Seed: 1, Files: 250, Size: 1 << 20, Distribution: EqualSizes}},
+		{"UniformSizes", TarOptions{Seed: 2, Files: 250, Size: 1 << 20, Distribution: UniformSizes}},
+		{"ExponentialSizes", TarOptions{Seed: 3, Files: 250, Size: 1 << 20, Distribution: ExponentialSizes}},
+		{"Depth", TarOptions{Seed: 4, Files: 10, Size: 1 << 10, Depth: 8}},
+		{"SingleFile", TarOptions{Seed: 5, Files: 1, Size: 100}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b1, b2 bytes.Buffer
+			if err := GenerateTar(&b1, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := GenerateTar(&b2, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			d1, d2 := digest.FromBytes(b1.Bytes()), digest.FromBytes(b2.Bytes())
+			if d1 != d2 {
+				t.Fatalf("Generated tars differ: %s and %s", d1, d2)
+			}
+
+			var (
+				files int
+				size  int64
+			)
+			tr := tar.NewReader(&b1)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeReg {
+					files++
+					size += hdr.Size
+				}
+			}
+			if files != tc.opts.Files {
+				t.Errorf("Unexpected %d files, expected %d", files, tc.opts.Files)
+			}
+			if size != tc.opts.Size {
+				t.Errorf("Unexpected total size %d, expected %d", size, tc.opts.Size)
+			}
+		})
+	}
+}
+
+func TestGenerateTarSeed(t *testing.T) {
+	opts := TarOptions{Seed: 1, Files: 10, Size: 1 << 10, Distribution: UniformSizes}
+	var b1, b2 bytes.Buffer
+	if err := GenerateTar(&b1, opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.Seed = 2
+	if err := GenerateTar(&b2, opts); err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(b1.Bytes()) == digest.FromBytes(b2.Bytes()) {
+		t.Fatal("Tars generated with different seeds are the same")
+	}
+}
@@ -0,0 +1,277 @@
+package dsdbench
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+func init() {
+	registerTests(
+		Test{Name: "RestartLayers", F: testRestartLayers},
+		Test{Name: "RestartRWLayer", F: testRestartRWLayer},
+	)
+}
+
+// layerTar returns the content of the layer's tar stream
+func layerTar(l layer.Layer) ([]byte, error) {
+	ts, err := l.TarStream()
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Close()
+	return ioutil.ReadAll(ts)
+}
+
+// changeStrings returns the sorted changes of a read-write layer
+func changeStrings(rw layer.RWLayer) ([]string, error) {
+	changes, err := rw.Changes()
+	if err != nil {
+		return nil, err
+	}
+	s := make([]string, len(changes))
+	for i, c := range changes {
+		s[i] = c.String()
+	}
+	sort.Strings(s)
+	return s, nil
+}
+
+// testRestartLayers creates a chain of layers and checks that the
+// layers and their metadata, content and tar streams are the same
+// after the layer store is reopened. A layer released before the
+// restart must not be loaded.
+func testRestartLayers(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cleanup(t, ls)
+	}()
+
+	layers := []LayerInit{
+		InitWithFiles(
+			CreateDirectory("/etc", 0755),
+			NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+			NewTestFile("/etc/profile", []byte("PATH=/usr/bin"), 0644),
+		),
+		InitWithFiles(
+			NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.20"), 0644),
+			CreateDirectory("/root", 0700),
+			NewTestFile("/root/.bashrc", []byte("PATH=/usr/sbin:/usr/bin"), 0644),
+		),
+		InitWithFiles(
+			RemoveFile("/etc/profile"),
+			NewTestFile("/etc/resolv.conf", []byte("nameserver 10.0.0.1"), 0644),
+			Link("/etc/resolv.conf", "/etc/resolv.conf.bak"),
+			Symlink("../etc/hosts", "/root/hosts"),
+		),
+	}
+
+	var (
+		parent layer.ChainID
+		chain  []layer.Layer
+		tars   [][]byte
+	)
+	for i, li := range layers {
+		l, err := CreateLayer(ls, parent, li)
+		if err != nil {
+			t.Fatalf("Failed to create layer %d: %+v", i+1, err)
+		}
+		tar, err := layerTar(l)
+		if err != nil {
+			t.Fatalf("Failed to read layer %d tar stream: %+v", i+1, err)
+		}
+		chain = append(chain, l)
+		tars = append(tars, tar)
+		parent = l.ChainID()
+	}
+
+	released, err := CreateLayer(ls, chain[0].ChainID(), InitWithFiles(
+		NewTestFile("/etc/released", []byte("released"), 0644),
+	))
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+	if _, err := ls.Release(released); err != nil {
+		t.Fatalf("Failed to release layer: %+v", err)
+	}
+
+	expected, err := CreateMetadata(chain...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := reopenLayerStore(ls)
+	if err != nil {
+		t.Fatalf("Failed to reopen layer store: %+v", err)
+	}
+	ls = rs
+
+	m := ls.Map()
+	if len(m) != len(chain) {
+		t.Errorf("unexpected %d layers after restart, expected %d", len(m), len(chain))
+	}
+	if _, ok := m[released.ChainID()]; ok {
+		t.Errorf("released layer %s loaded after restart", released.ChainID())
+	}
+
+	var reopened []layer.Layer
+	for i, e := range expected {
+		l, err := ls.Get(e.ChainID)
+		if err != nil {
+			t.Fatalf("Failed to get layer %d after restart: %+v", i+1, err)
+		}
+		defer ls.Release(l)
+		reopened = append(reopened, l)
+
+		var expectedParent, actualParent layer.ChainID
+		if i > 0 {
+			expectedParent = expected[i-1].ChainID
+		}
+		if p := l.Parent(); p != nil {
+			actualParent = p.ChainID()
+		}
+		if actualParent != expectedParent {
+			t.Errorf("unexpected parent %q of layer %d after restart, expected %q", actualParent, i+1, expectedParent)
+		}
+
+		if err := CheckLayerDiff(tars[i], l); err != nil {
+			t.Errorf("Layer %d tar stream check failure after restart: %+v", i+1, err)
+		}
+		if err := CheckLayer(ls, l.ChainID(), layers[:i+1]...); err != nil {
+			t.Errorf("Layer %d check failure after restart: %+v", i+1, err)
+		}
+	}
+
+	metadata, err := CreateMetadata(reopened...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMetadata(metadata, expected); err != nil {
+		t.Errorf("Metadata check failure after restart: %+v", err)
+	}
+}
+
+// testRestartRWLayer updates a read-write layer with an init layer and
+// checks that the read-write layer and its content are the same after
+// the layer store is reopened.
+func testRestartRWLayer(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cleanup(t, ls)
+	}()
+
+	files := []ApplyFile{
+		CreateDirectory("/etc", 0755),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+		NewTestFile("/etc/profile", []byte("PATH=/usr/bin"), 0644),
+		CreateDirectory("/var/log", 0755),
+	}
+	initFiles := []ApplyFile{
+		NewTestFile("/etc/hostname", []byte("container"), 0644),
+		NewTestFile("/etc/hosts", []byte("container 172.17.0.2"), 0644),
+	}
+	updates := []ApplyFile{
+		NewTestFile("/etc/profile", []byte("PATH=/usr/sbin:/usr/bin"), 0644),
+		NewTestFile("/var/log/messages", []byte("started"), 0644),
+		RemoveFile("/etc/hostname"),
+	}
+
+	td, err := ioutil.TempDir("", "check-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err := InitWithFiles(append(append(files, initFiles...), updates...)...)(td); err != nil {
+		t.Fatal(err)
+	}
+
+	l1, err := CreateLayer(ls, "", InitWithFiles(files...))
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+
+	id := stringid.GenerateRandomID()
+	rw, err := ls.CreateRWLayer(id, l1.ChainID(), &layer.CreateRWLayerOpts{
+		InitFunc: layer.MountInit(InitWithFiles(initFiles...)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rw layer: %+v", err)
+	}
+	p, err := rw.Mount("")
+	if err != nil {
+		t.Fatalf("Failed to mount: %+v", err)
+	}
+	if err := InitWithFiles(updates...)(p); err != nil {
+		rw.Unmount()
+		t.Fatal(err)
+	}
+	if err := rw.Unmount(); err != nil {
+		t.Fatalf("Failed to unmount: %+v", err)
+	}
+
+	mountID, err := ls.GetMountID(id)
+	if err != nil {
+		t.Fatalf("Failed to get mount id: %+v", err)
+	}
+	changes, err := changeStrings(rw)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	}
+
+	rs, err := reopenLayerStore(ls)
+	if err != nil {
+		t.Fatalf("Failed to reopen layer store: %+v", err)
+	}
+	ls = rs
+
+	rw, err = ls.GetRWLayer(id)
+	if err != nil {
+		t.Fatalf("Failed to get rw layer after restart: %+v", err)
+	}
+	defer func() {
+		if _, err := ls.ReleaseRWLayer(rw); err != nil {
+			t.Errorf("Failed to release rw layer: %+v", err)
+		}
+	}()
+
+	if rw.Name() != id {
+		t.Errorf("unexpected rw layer name %q after restart, expected %q", rw.Name(), id)
+	}
+	if parent := rw.Parent(); parent == nil || parent.ChainID() != l1.ChainID() {
+		t.Errorf("unexpected rw layer parent %v after restart, expected %s", parent, l1.ChainID())
+	}
+	if actual, err := ls.GetMountID(id); err != nil {
+		t.Errorf("Failed to get mount id after restart: %+v", err)
+	} else if actual != mountID {
+		t.Errorf("unexpected mount id %q after restart, expected %q", actual, mountID)
+	}
+	if actual, err := changeStrings(rw); err != nil {
+		t.Errorf("Failed to get changes after restart: %+v", err)
+	} else if fmt.Sprint(actual) != fmt.Sprint(changes) {
+		t.Errorf("unexpected changes %v after restart, expected %v", actual, changes)
+	}
+
+	p, err = rw.Mount("")
+	if err != nil {
+		t.Fatalf("Failed to mount after restart: %+v", err)
+	}
+	defer func() {
+		if err := rw.Unmount(); err != nil {
+			t.Errorf("Failed to unmount: %+v", err)
+		}
+	}()
+
+	if err := CheckDirectoryEqual(p, td); err != nil {
+		t.Fatalf("Mount check failure after restart: %+v", err)
+	}
+}
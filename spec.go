@@ -0,0 +1,289 @@
+package dsdbench
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/layer"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Spec describes a layer chain test which can be written as a JSON or
+// YAML file and replayed against any storage driver without writing Go.
+//
+//	name: rename-lower-directory
+//	layers:
+//	- files:
+//	  - {op: mkdir, path: /dir}
+//	  - {op: create, path: /dir/f1, content: "1", mode: "0644"}
+//	- files:
+//	  - {op: rename, path: /dir, target: /newdir}
+//	  expect:
+//	  - {op: mkdir, path: /newdir}
+//	  - {op: create, path: /newdir/f1, content: "1"}
+type Spec struct {
+	// Name is the test name, defaults to the spec file name
+	Name string `json:"name,omitempty"`
+
+	// Description describes the scenario being tested
+	Description string `json:"description,omitempty"`
+
+	// Layers are the layers of the chain from the bottom up
+	Layers []LayerSpec `json:"layers"`
+}
+
+// LayerSpec describes a single layer in a spec
+type LayerSpec struct {
+	// Files are the file operations applied to create the layer
+	Files []FileSpec `json:"files"`
+
+	// Expect are the file operations which create the expected content
+	// of the layer in an empty directory. When empty the layer is
+	// expected to match the files of this and all lower layers applied
+	// to a single directory.
+	Expect []FileSpec `json:"expect,omitempty"`
+}
+
+// FileSpec describes a single file operation. The operation is one of
+// "create", "mkdir", "remove", "rename", "link", "symlink", "chmod",
+// "chown", "xattr", "chardev", "blockdev", "fifo" or "socket". The
+// path is renamed or linked to the target, a symlink is created at the
+// path pointing to the target and an xattr operation sets the attribute
+// to the content.
+type FileSpec struct {
+	Op      string   `json:"op"`
+	Path    string   `json:"path"`
+	Target  string   `json:"target,omitempty"`
+	Content string   `json:"content,omitempty"`
+	Mode    specMode `json:"mode,omitempty"`
+	Attr    string   `json:"attr,omitempty"`
+	UID     int      `json:"uid,omitempty"`
+	GID     int      `json:"gid,omitempty"`
+	Major   int64    `json:"major,omitempty"`
+	Minor   int64    `json:"minor,omitempty"`
+}
+
+// specMode is a file mode given as an octal string such as "0644".
+// Numbers are rejected since a YAML octal number and a JSON number
+// written in octal both decode to the same value, so "mode: 644"
+// cannot be told apart from 0644. The setuid, setgid and sticky bits
+// are given as in chmod, "4755".
+type specMode os.FileMode
+
+func (m *specMode) UnmarshalJSON(b []byte) error {
+	if !strings.HasPrefix(string(b), `"`) {
+		return errors.Errorf("invalid mode %s, must be a quoted octal string", b)
+	}
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if err != nil || v > 07777 {
+		return errors.Errorf("invalid mode %s", b)
+	}
+	mode := os.FileMode(v) & os.ModePerm
+	if v&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if v&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if v&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	*m = specMode(mode)
+	return nil
+}
+
+func (m specMode) perm(def os.FileMode) os.FileMode {
+	if m == 0 {
+		return def
+	}
+	return os.FileMode(m)
+}
+
+// LoadSpec reads a JSON or YAML spec file, the spec is named after the
+// file when no name is given.
+func LoadSpec(path string) (*Spec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Spec
+	if err := yaml.Unmarshal(b, &s, yaml.DisallowUnknownFields); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	if s.Name == "" {
+		base := filepath.Base(path)
+		s.Name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if _, err := s.LayerInits(); err != nil {
+		return nil, errors.Wrapf(err, "invalid spec %s", path)
+	}
+
+	return &s, nil
+}
+
+// LayerInits returns the layer initializers for each layer in the spec
+func (s *Spec) LayerInits() ([]LayerInit, error) {
+	if len(s.Layers) == 0 {
+		return nil, errors.New("no layers")
+	}
+	inits := make([]LayerInit, len(s.Layers))
+	for i, l := range s.Layers {
+		li, err := initFromSpec(l.Files)
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %d", i+1)
+		}
+		if _, err := initFromSpec(l.Expect); err != nil {
+			return nil, errors.Wrapf(err, "layer %d expect", i+1)
+		}
+		inits[i] = li
+	}
+	return inits, nil
+}
+
+// expected returns the layer initializers for the expected content
+// of the layer at the given index.
+func (s *Spec) expected(i int, inits []LayerInit) ([]LayerInit, error) {
+	if len(s.Layers[i].Expect) == 0 {
+		return inits[:i+1], nil
+	}
+	li, err := initFromSpec(s.Layers[i].Expect)
+	if err != nil {
+		return nil, err
+	}
+	return []LayerInit{li}, nil
+}
+
+func initFromSpec(files []FileSpec) (LayerInit, error) {
+	appliers := make([]ApplyFile, len(files))
+	for i, f := range files {
+		a, err := f.applier()
+		if err != nil {
+			return nil, errors.Wrapf(err, "file %d", i+1)
+		}
+		appliers[i] = a
+	}
+	return InitWithFiles(appliers...), nil
+}
+
+func (f FileSpec) applier() (ApplyFile, error) {
+	if f.Path == "" {
+		return nil, errors.Errorf("%s: missing path", f.Op)
+	}
+	switch f.Op {
+	case "create":
+		return NewTestFile(f.Path, []byte(f.Content), f.Mode.perm(0644)), nil
+	case "mkdir":
+		return CreateDirectory(f.Path, f.Mode.perm(0755)), nil
+	case "remove":
+		return RemoveFile(f.Path), nil
+	case "rename":
+		if f.Target == "" {
+			return nil, errors.Errorf("%s: missing target", f.Op)
+		}
+		return Rename(f.Path, f.Target), nil
+	case "link":
+		if f.Target == "" {
+			return nil, errors.Errorf("%s: missing target", f.Op)
+		}
+		return Link(f.Path, f.Target), nil
+	case "symlink":
+		if f.Target == "" {
+			return nil, errors.Errorf("%s: missing target", f.Op)
+		}
+		return Symlink(f.Target, f.Path), nil
+	case "chmod":
+		if f.Mode == 0 {
+			return nil, errors.Errorf("%s: missing mode", f.Op)
+		}
+		return Chmod(f.Path, os.FileMode(f.Mode)), nil
+	case "chown":
+		return Chown(f.Path, f.UID, f.GID), nil
+	case "xattr":
+		if f.Attr == "" {
+			return nil, errors.Errorf("%s: missing attr", f.Op)
+		}
+		return SetXattr(f.Path, f.Attr, []byte(f.Content)), nil
+	case "chardev":
+		return CreateDevice(f.Path, f.Mode.perm(0666)|os.ModeDevice|os.ModeCharDevice, f.Major, f.Minor), nil
+	case "blockdev":
+		return CreateDevice(f.Path, f.Mode.perm(0660)|os.ModeDevice, f.Major, f.Minor), nil
+	case "fifo":
+		return CreateFifo(f.Path, f.Mode.perm(0644)), nil
+	case "socket":
+		return CreateSocket(f.Path), nil
+	}
+	return nil, errors.Errorf("unknown operation %q", f.Op)
+}
+
+// RunSpec creates the layer chain described by the spec and checks the
+// content of each layer.
+func RunSpec(t T, s *Spec) {
+	inits, err := s.LayerInits()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	var (
+		l      layer.Layer
+		parent layer.ChainID
+	)
+	for i := range s.Layers {
+		previous := l
+		l, err = CreateLayer(ls, parent, inits[i])
+		if err != nil {
+			t.Fatalf("Failed to create layer %d: %+v", i+1, err)
+		}
+		parent = l.ChainID()
+		if previous != nil {
+			if _, err := ls.Release(previous); err != nil {
+				t.Fatalf("Failed to release layer %d: %+v", i, err)
+			}
+		}
+
+		expected, err := s.expected(i, inits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckLayer(ls, l.ChainID(), expected...); err != nil {
+			t.Errorf("Layer %d check failure: %+v", i+1, err)
+		}
+	}
+
+	if _, err := ls.Release(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// SpecTests loads the spec files and returns a test for each, such
+// as for specs attached to a bug report.
+func SpecTests(paths ...string) ([]Test, error) {
+	tests := make([]Test, len(paths))
+	for i, p := range paths {
+		s, err := LoadSpec(p)
+		if err != nil {
+			return nil, err
+		}
+		tests[i] = Test{
+			Name: s.Name,
+			F: func(t T) {
+				RunSpec(t, s)
+			},
+		}
+	}
+	return tests, nil
+}
@@ -0,0 +1,129 @@
+package dsdbench
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeSpec(t *testing.T, name, content string) string {
+	td, err := ioutil.TempDir("", "spec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(td, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		os.RemoveAll(td)
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadSpecMode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		content  string
+		expected os.FileMode
+		invalid  bool
+	}{
+		{"JSONString", "s.json", `{"layers": [{"files": [{"op": "create", "path": "/f", "mode": "0600"}]}]}`, 0600, false},
+		{"JSONNumber", "s.json", `{"layers": [{"files": [{"op": "create", "path": "/f", "mode": 644}]}]}`, 0, true},
+		{"JSONSticky", "s.json", `{"layers": [{"files": [{"op": "mkdir", "path": "/d", "mode": "1777"}]}]}`, os.ModeSticky | 0777, false},
+		{"JSONNotOctal", "s.json", `{"layers": [{"files": [{"op": "create", "path": "/f", "mode": "0698"}]}]}`, 0, true},
+		{"JSONTooLarge", "s.json", `{"layers": [{"files": [{"op": "create", "path": "/f", "mode": "17777"}]}]}`, 0, true},
+		{"YAMLString", "s.yaml", "layers:\n- files:\n  - {op: create, path: /f, mode: \"0600\"}\n", 0600, false},
+		{"YAMLOctalPrefix", "s.yaml", "layers:\n- files:\n  - {op: create, path: /f, mode: \"0o4755\"}\n", os.ModeSetuid | 0755, false},
+		{"YAMLNumber", "s.yaml", "layers:\n- files:\n  - {op: create, path: /f, mode: 644}\n", 0, true},
+		{"YAMLOctalNumber", "s.yaml", "layers:\n- files:\n  - {op: create, path: /f, mode: 0644}\n", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := writeSpec(t, tc.file, tc.content)
+			defer os.RemoveAll(filepath.Dir(p))
+
+			s, err := LoadSpec(p)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("Expected error loading mode, got %v", os.FileMode(s.Layers[0].Files[0].Mode))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m := os.FileMode(s.Layers[0].Files[0].Mode); m != tc.expected {
+				t.Fatalf("Unexpected mode %v, expected %v", m, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLoadSpecUnknownField(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"JSONSpec", "s.json", `{"layers": [{"files": [{"op": "mkdir", "path": "/d"}]}], "layer": []}`},
+		{"JSONFile", "s.json", `{"layers": [{"files": [{"op": "mkdir", "path": "/d", "perm": "0755"}]}]}`},
+		{"YAMLSpec", "s.yaml", "layers:\n- files:\n  - {op: mkdir, path: /d}\nlayer: []\n"},
+		{"YAMLFile", "s.yaml", "layers:\n- files:\n  - {op: mkdir, path: /d, perm: \"0755\"}\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := writeSpec(t, tc.file, tc.content)
+			defer os.RemoveAll(filepath.Dir(p))
+
+			if _, err := LoadSpec(p); err == nil {
+				t.Fatal("Expected error loading unknown field")
+			}
+		})
+	}
+}
+
+func TestLoadSpecYAMLMatchesJSON(t *testing.T) {
+	jp := writeSpec(t, "rename.json", `{
+	"description": "rename lower directory",
+	"layers": [
+		{"files": [
+			{"op": "mkdir", "path": "/dir"},
+			{"op": "create", "path": "/dir/f1", "content": "1", "mode": "0600"}
+		]},
+		{"files": [
+			{"op": "rename", "path": "/dir", "target": "/newdir"}
+		], "expect": [
+			{"op": "mkdir", "path": "/newdir"},
+			{"op": "create", "path": "/newdir/f1", "content": "1", "mode": "0600"}
+		]}
+	]
+}`)
+	defer os.RemoveAll(filepath.Dir(jp))
+	yp := writeSpec(t, "rename.yaml", `description: rename lower directory
+layers:
+- files:
+  - {op: mkdir, path: /dir}
+  - {op: create, path: /dir/f1, content: "1", mode: "0600"}
+- files:
+  - {op: rename, path: /dir, target: /newdir}
+  expect:
+  - {op: mkdir, path: /newdir}
+  - {op: create, path: /newdir/f1, content: "1", mode: "0600"}
+`)
+	defer os.RemoveAll(filepath.Dir(yp))
+
+	js, err := LoadSpec(jp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ys, err := LoadSpec(yp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if js.Name != "rename" {
+		t.Fatalf("Unexpected name %q, expected name of file", js.Name)
+	}
+	if !reflect.DeepEqual(js, ys) {
+		t.Fatalf("YAML spec %+v does not match JSON spec %+v", ys, js)
+	}
+}
@@ -0,0 +1,148 @@
+package dsdbench
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+
+	"github.com/docker/docker/layer"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	registerTests(
+		Test{Name: "DeviceCommit", F: testDeviceCommit},
+		Test{Name: "DeviceRegister", F: testDeviceRegister},
+		Test{Name: "FifoCommit", F: testFifoCommit},
+		Test{Name: "FifoRegister", F: testFifoRegister},
+	)
+}
+
+// tarEntry is the expected type and device numbers of a tar entry
+type tarEntry struct {
+	typeflag byte
+	major    int64
+	minor    int64
+}
+
+// checkTarEntries checks the type and device numbers of entries in the
+// layer's tar stream, an entry with no type must not be in the stream.
+func checkTarEntries(l layer.Layer, entries map[string]tarEntry) error {
+	headers, err := TarHeaders(l)
+	if err != nil {
+		return err
+	}
+
+	for p, e := range entries {
+		hdr, ok := headers[p]
+		if e.typeflag == 0 {
+			if ok {
+				return errors.Errorf("unexpected %s in tar stream", p)
+			}
+			continue
+		}
+		if !ok {
+			return errors.Errorf("missing %s in tar stream", p)
+		}
+		if hdr.Typeflag != e.typeflag {
+			return errors.Errorf("unexpected type %q for %s in tar stream, expected %q", hdr.Typeflag, p, e.typeflag)
+		}
+		if hdr.Devmajor != e.major || hdr.Devminor != e.minor {
+			return errors.Errorf("unexpected device %d:%d for %s in tar stream, expected %d:%d", hdr.Devmajor, hdr.Devminor, p, e.major, e.minor)
+		}
+	}
+
+	return nil
+}
+
+// tarEntries returns a check of the entries in the tar stream of the
+// layer
+func tarEntries(entries map[string]tarEntry) layerCheck {
+	return func(l layer.Layer) error {
+		return checkTarEntries(l, entries)
+	}
+}
+
+// registerLayerTest registers a layer from a tar created with the
+// files and checks the layer content and tar stream.
+func registerLayerTest(t T, files []ApplyFile, entries map[string]tarEntry) {
+	layerTest(t, func(ls layer.Store) (layer.Layer, error) {
+		tar1, err := TarFromFiles(files...)
+		if err != nil {
+			return nil, err
+		}
+		return ls.Register(bytes.NewReader(tar1), "")
+	}, []LayerInit{InitWithFiles(files...)}, tarEntries(entries))
+}
+
+func deviceFiles() []ApplyFile {
+	return []ApplyFile{
+		CreateDirectory("/dev", 0755),
+		CreateDevice("/dev/null", 0666|os.ModeDevice|os.ModeCharDevice, 1, 3),
+		CreateDevice("/dev/zero", 0666|os.ModeDevice|os.ModeCharDevice, 1, 5),
+		CreateDevice("/dev/loop0", 0660|os.ModeDevice, 7, 0),
+		CreateDevice("/dev/loop300", 0660|os.ModeDevice, 7, 300),
+	}
+}
+
+var deviceEntries = map[string]tarEntry{
+	"/dev/null":    {tar.TypeChar, 1, 3},
+	"/dev/zero":    {tar.TypeChar, 1, 5},
+	"/dev/loop0":   {tar.TypeBlock, 7, 0},
+	"/dev/loop300": {tar.TypeBlock, 7, 300},
+}
+
+func testDeviceCommit(t T) {
+	requireRoot(t)
+
+	l1Init := InitWithFiles(deviceFiles()...)
+	l2Init := InitWithFiles(
+		Chown("/dev/loop0", 0, 6),
+		RemoveFile("/dev/zero"),
+		CreateDevice("/dev/zero", 0666|os.ModeDevice|os.ModeCharDevice, 1, 7),
+	)
+
+	simpleLayerTest(t, tarEntries(deviceEntries), l1Init)
+	simpleLayerTest(t, tarEntries(map[string]tarEntry{
+		"/dev/loop0": {tar.TypeBlock, 7, 0},
+		"/dev/zero":  {tar.TypeChar, 1, 7},
+		"/dev/null":  {},
+	}), l1Init, l2Init)
+}
+
+func testDeviceRegister(t T) {
+	requireRoot(t)
+
+	registerLayerTest(t, deviceFiles(), deviceEntries)
+}
+
+func fifoFiles() []ApplyFile {
+	return []ApplyFile{
+		CreateDirectory("/run", 0755),
+		CreateFifo("/run/initctl", 0600),
+		CreateFifo("/run/public", 0666),
+	}
+}
+
+var fifoEntries = map[string]tarEntry{
+	"/run/initctl": {tar.TypeFifo, 0, 0},
+	"/run/public":  {tar.TypeFifo, 0, 0},
+}
+
+func testFifoCommit(t T) {
+	l1Init := InitWithFiles(fifoFiles()...)
+	l2Init := InitWithFiles(
+		RemoveFile("/run/public"),
+		CreateFifo("/run/private", 0600),
+	)
+
+	simpleLayerTest(t, tarEntries(fifoEntries), l1Init)
+	simpleLayerTest(t, tarEntries(map[string]tarEntry{
+		"/run/private": {tar.TypeFifo, 0, 0},
+		"/run/initctl": {},
+	}), l1Init, l2Init)
+}
+
+func testFifoRegister(t T) {
+	registerLayerTest(t, fifoFiles(), fifoEntries)
+}
@@ -0,0 +1,407 @@
+package dsdbench
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultStressDuration is the default duration of the stress test
+	DefaultStressDuration = 5 * time.Second
+
+	// DefaultStressConcurrency is the default number of goroutines
+	// running operations in the stress test
+	DefaultStressConcurrency = 8
+
+	// stressHistory is the number of operations kept for each worker
+	// to report with an error
+	stressHistory = 20
+
+	// stressTars is the number of different layer tars registered by
+	// the workers, the same layer is registered by many workers at the
+	// same time.
+	stressTars = 4
+)
+
+func init() {
+	registerTests(
+		Test{Name: "Stress", F: testStress},
+	)
+}
+
+// stressParent is a layer shared by the workers and a directory with
+// its expected content
+type stressParent struct {
+	chainID layer.ChainID
+	dir     string
+}
+
+// stress is the state shared by the stress workers
+type stress struct {
+	ls      layer.Store
+	parents []stressParent
+	shared  layer.RWLayer
+	tars    [][]byte
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// stressWorker runs random layer store operations until stopped
+type stressWorker struct {
+	id      int
+	s       *stress
+	rand    *rand.Rand
+	start   time.Time
+	history []string
+}
+
+// record adds an operation to the history of the worker
+func (w *stressWorker) record(op, format string, args ...interface{}) {
+	entry := fmt.Sprintf("%10s %-10s %s", time.Since(w.start).Round(time.Microsecond), op, fmt.Sprintf(format, args...))
+	if len(w.history) == stressHistory {
+		w.history = w.history[1:]
+	}
+	w.history = append(w.history, entry)
+
+	w.s.mu.Lock()
+	w.s.counts[op]++
+	w.s.mu.Unlock()
+}
+
+// run runs operations until the stop time, returning the first error
+func (w *stressWorker) run(stop time.Time) error {
+	ops := []func() error{w.container, w.shared, w.register}
+	for time.Now().Before(stop) {
+		if err := ops[w.rand.Intn(len(ops))](); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *stressWorker) parent() stressParent {
+	return w.s.parents[w.rand.Intn(len(w.s.parents))]
+}
+
+// container creates, mounts, checks, updates, unmounts and releases a
+// read-write layer as done when running a container
+func (w *stressWorker) container() error {
+	p := w.parent()
+	id := stringid.GenerateRandomID()
+	w.record("create-rw", "%s on %s", stringid.TruncateID(id), p.chainID)
+	rw, err := w.s.ls.CreateRWLayer(id, p.chainID, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create rw layer")
+	}
+
+	w.record("mount", "%s", stringid.TruncateID(id))
+	path, err := rw.Mount("")
+	if err != nil {
+		w.s.ls.ReleaseRWLayer(rw)
+		return errors.Wrap(err, "failed to mount")
+	}
+
+	checkErr := CheckDirectoryEqual(path, p.dir)
+	if checkErr == nil {
+		content := []byte(fmt.Sprintf("worker %d", w.id))
+		name := filepath.Join(path, "stress")
+		if err := ioutil.WriteFile(name, content, 0644); err != nil {
+			checkErr = errors.Wrap(err, "failed to write")
+		} else if b, err := ioutil.ReadFile(name); err != nil {
+			checkErr = errors.Wrap(err, "failed to read")
+		} else if !bytes.Equal(b, content) {
+			checkErr = errors.Errorf("unexpected content %q, expected %q", b, content)
+		}
+	}
+
+	w.record("unmount", "%s", stringid.TruncateID(id))
+	if err := rw.Unmount(); err != nil {
+		return errors.Wrap(err, "failed to unmount")
+	}
+	w.record("release-rw", "%s", stringid.TruncateID(id))
+	removed, err := w.s.ls.ReleaseRWLayer(rw)
+	if err != nil {
+		return errors.Wrap(err, "failed to release rw layer")
+	}
+	if len(removed) > 0 {
+		return errors.Errorf("release of rw layer on held parent removed %d layers", len(removed))
+	}
+
+	return errors.Wrap(checkErr, "mount check failure")
+}
+
+// shared mounts and checks the read-write layer shared by all workers
+func (w *stressWorker) shared() error {
+	w.record("mount", "shared %s", stringid.TruncateID(w.s.shared.Name()))
+	path, err := w.s.shared.Mount("")
+	if err != nil {
+		return errors.Wrap(err, "failed to mount shared rw layer")
+	}
+
+	checkErr := CheckDirectoryEqual(path, w.s.parents[0].dir)
+
+	w.record("unmount", "shared %s", stringid.TruncateID(w.s.shared.Name()))
+	if err := w.s.shared.Unmount(); err != nil {
+		return errors.Wrap(err, "failed to unmount shared rw layer")
+	}
+
+	return errors.Wrap(checkErr, "shared mount check failure")
+}
+
+// register registers one of the layer tars, likely registered by other
+// workers at the same time, and checks the layer's tar stream
+func (w *stressWorker) register() error {
+	p := w.parent()
+	i := w.rand.Intn(len(w.s.tars))
+	w.record("register", "tar %d on %s", i, p.chainID)
+	l, err := w.s.ls.Register(bytes.NewReader(w.s.tars[i]), p.chainID)
+	if err != nil {
+		return errors.Wrap(err, "failed to register")
+	}
+
+	var checkErr error
+	ts, err := l.TarStream()
+	if err != nil {
+		checkErr = errors.Wrap(err, "failed to get tar stream")
+	} else {
+		dgst, err := digest.FromReader(ts)
+		ts.Close()
+		if err != nil {
+			checkErr = errors.Wrap(err, "failed to read tar stream")
+		} else if layer.DiffID(dgst) != l.DiffID() {
+			checkErr = errors.Errorf("tar stream digest %s does not match diff id %s", dgst, l.DiffID())
+		}
+	}
+
+	w.record("release", "%s", l.ChainID())
+	removed, err := w.s.ls.Release(l)
+	if err != nil {
+		return errors.Wrap(err, "failed to release")
+	}
+	// The layer is removed only by the last release, its parent is
+	// held by the test and is never removed
+	if len(removed) > 1 || len(removed) == 1 && removed[0].ChainID != l.ChainID() {
+		return errors.Errorf("release of %s removed unexpected layers %v", l.ChainID(), removedChainIDs(removed))
+	}
+
+	return checkErr
+}
+
+// removedChainIDs returns the chain IDs of the layers removed by a
+// release
+func removedChainIDs(removed []layer.Metadata) []layer.ChainID {
+	ids := make([]layer.ChainID, len(removed))
+	for i, m := range removed {
+		ids[i] = m.ChainID
+	}
+	return ids
+}
+
+// stressChains are the layer chains shared by the workers
+var stressChains = [][]LayerInit{
+	{
+		InitWithFiles(
+			CreateDirectory("/etc", 0755),
+			NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+			CreateDirectory("/bin", 0755),
+			NewTestFile("/bin/sh", []byte("#!/bin/sh"), 0755),
+		),
+		InitWithFiles(
+			NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.120"), 0644),
+			CreateDirectory("/usr/lib", 0755),
+			NewTestFile("/usr/lib/libc.so", bytes.Repeat([]byte("libc"), 4096), 0644),
+		),
+		InitWithFiles(
+			RemoveFile("/bin/sh"),
+			NewTestFile("/bin/bash", []byte("#!/bin/bash"), 0755),
+		),
+	},
+	{
+		InitWithFiles(
+			CreateDirectory("/app", 0755),
+			NewTestFile("/app/main", []byte("main"), 0755),
+		),
+		InitWithFiles(
+			CreateDirectory("/app/config", 0700),
+			NewTestFile("/app/config/app.yaml", []byte("workers: 8"), 0600),
+		),
+	},
+}
+
+// testStress runs layer store operations concurrently on shared
+// layers for the configured duration. Each mount is checked and no
+// mounts may be left when the operations are done. Each release must
+// remove only the released layer once it is no longer referenced and
+// no layers may be left once the shared layers are released.
+func testStress(t T) {
+	duration := config.StressDuration
+	concurrency := config.StressConcurrency
+	if duration == 0 || concurrency == 0 {
+		t.Skip("stress test disabled, stress duration or concurrency is zero")
+	}
+
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	s := &stress{
+		ls:     ls,
+		counts: map[string]int{},
+	}
+
+	// held are the shared layers, released when the test fails before
+	// they are released and checked
+	var held []layer.Layer
+	defer func() {
+		for _, l := range held {
+			ls.Release(l)
+		}
+	}()
+	for i, chain := range stressChains {
+		var parent layer.ChainID
+		for j, li := range chain {
+			l, err := CreateLayer(ls, parent, li)
+			if err != nil {
+				t.Fatalf("Failed to create layer %d of chain %d: %+v", j+1, i+1, err)
+			}
+			held = append(held, l)
+			parent = l.ChainID()
+
+			td, err := ioutil.TempDir("", "stress-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(td)
+			for _, li := range chain[:j+1] {
+				if err := li(td); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.parents = append(s.parents, stressParent{chainID: parent, dir: td})
+		}
+	}
+	for i := 0; i < stressTars; i++ {
+		tar, err := TarFromFiles(
+			CreateDirectory("/var/lib", 0755),
+			NewTestFile(fmt.Sprintf("/var/lib/data%d", i), bytes.Repeat([]byte{byte(i)}, 8192), 0644),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.tars = append(s.tars, tar)
+	}
+
+	s.shared, err = ls.CreateRWLayer(stringid.GenerateRandomID(), s.parents[0].chainID, nil)
+	if err != nil {
+		t.Fatalf("Failed to create shared rw layer: %+v", err)
+	}
+	defer func() {
+		if s.shared != nil {
+			ls.ReleaseRWLayer(s.shared)
+		}
+	}()
+
+	var (
+		root   string
+		before []string
+	)
+	if store, ok := ls.(*layerStore); ok {
+		root = store.tempDir
+		if before, err = mountsUnder(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seed := time.Now().UnixNano()
+	t.Logf("running %d workers for %s with seed %d", concurrency, duration, seed)
+
+	start := time.Now()
+	stop := start.Add(duration)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		w := &stressWorker{
+			id:    i,
+			s:     s,
+			rand:  rand.New(rand.NewSource(seed + int64(i))),
+			start: start,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.run(stop); err != nil {
+				t.Errorf("worker %d: %+v\nlast operations:\n%s", w.id, err, strings.Join(w.history, "\n"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var ops []string
+	for op, n := range s.counts {
+		ops = append(ops, fmt.Sprintf("%s=%d", op, n))
+	}
+	sort.Strings(ops)
+	t.Logf("operations: %s", strings.Join(ops, " "))
+
+	if root != "" {
+		after, err := mountsUnder(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaked := mountDiff(after, before); len(leaked) > 0 {
+			t.Errorf("mounts left after stress: %s", strings.Join(leaked, ", "))
+		}
+	}
+
+	m := ls.Map()
+	for _, p := range s.parents {
+		if _, ok := m[p.chainID]; !ok {
+			t.Errorf("shared layer %s missing after stress", p.chainID)
+		}
+		delete(m, p.chainID)
+	}
+	for chainID := range m {
+		t.Errorf("registered layer %s left after stress", chainID)
+	}
+
+	removed, err := ls.ReleaseRWLayer(s.shared)
+	if err != nil {
+		t.Fatalf("Failed to release shared rw layer: %+v", err)
+	}
+	s.shared = nil
+	if len(removed) > 0 {
+		t.Errorf("release of shared rw layer removed unexpected layers %v", removedChainIDs(removed))
+	}
+
+	// Each shared layer is held once and its parent is still held when
+	// it is released, releasing from the top removes one layer each
+	for len(held) > 0 {
+		l := held[len(held)-1]
+		held = held[:len(held)-1]
+		removed, err := ls.Release(l)
+		if err != nil {
+			t.Fatalf("Failed to release shared layer %s: %+v", l.ChainID(), err)
+		}
+		if len(removed) != 1 || removed[0].ChainID != l.ChainID() {
+			t.Errorf("release of shared layer %s removed %v, expected only the released layer", l.ChainID(), removedChainIDs(removed))
+		}
+	}
+	if m := ls.Map(); len(m) > 0 {
+		t.Errorf("%d layers left after releasing all layers", len(m))
+	}
+}
@@ -0,0 +1,91 @@
+package dsdbench
+
+import "testing"
+
+// T is the interface used by the storage driver tests to report
+// results. It is implemented by *testing.T when run using "go test".
+type T interface {
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	Fail()
+	FailNow()
+	Failed() bool
+	Fatal(args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Log(args ...interface{})
+	Logf(format string, args ...interface{})
+	Name() string
+	Skip(args ...interface{})
+	SkipNow()
+	Skipf(format string, args ...interface{})
+	Skipped() bool
+}
+
+// Test is a named storage driver test
+type Test struct {
+	Name string
+	F    func(T)
+}
+
+// Benchmark is a named storage driver benchmark
+type Benchmark struct {
+	Name string
+	F    func(*testing.B)
+
+	// ReportAllocs reports the memory allocations of the benchmark
+	// even when not requested for all benchmarks
+	ReportAllocs bool
+
+	// Large is set for benchmarks which use 256MB or more of data or
+	// a million files, these are skipped unless large benchmarks are
+	// enabled in the configuration
+	Large bool
+}
+
+var (
+	tests      []Test
+	benchmarks []Benchmark
+	crashTests []Test
+)
+
+func registerTests(t ...Test) {
+	tests = append(tests, t...)
+}
+
+func registerBenchmarks(bs ...Benchmark) {
+	for _, bench := range bs {
+		if bench.Large {
+			f := bench.F
+			bench.F = func(b *testing.B) {
+				if !config.LargeBenchmarks {
+					b.Skip("large benchmark, enable with -large")
+				}
+				f(b)
+			}
+		}
+		benchmarks = append(benchmarks, bench)
+	}
+}
+
+func registerCrashTests(t ...Test) {
+	crashTests = append(crashTests, t...)
+}
+
+// Tests returns all the storage driver tests in the order
+// they were registered.
+func Tests() []Test {
+	return append([]Test(nil), tests...)
+}
+
+// Benchmarks returns all the storage driver benchmarks in the
+// order they were registered.
+func Benchmarks() []Benchmark {
+	return append([]Benchmark(nil), benchmarks...)
+}
+
+// CrashTests returns the crash consistency tests, these are not part
+// of Tests since they check the layer store after a process using it
+// is killed, which no driver is expected to fully survive.
+func CrashTests() []Test {
+	return append([]Test(nil), crashTests...)
+}
@@ -0,0 +1,60 @@
+package dsdbench
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/reexec"
+)
+
+// runCrash enables the crash consistency tests
+var runCrash bool
+
+func init() {
+	reexec.Init()
+
+	flag.StringVar(&config.Root, "dir", "", "Default root of test directory")
+	flag.BoolVar(&config.Keep, "keep", false, "Keep test file directory")
+	flag.BoolVar(&config.ForceUnmount, "force-unmount", false, "Unmount mounts leaked by a test")
+	flag.StringVar(&config.Plugin, "plugin", "", "Graph driver plugin socket or spec file")
+	flag.BoolVar(&config.Proxy, "proxy", false, "Run graph driver as plugin from test process")
+	flag.BoolVar(&config.DropCaches, "drop-caches", false, "Drop system caches in cold cache benchmarks")
+	flag.BoolVar(&config.LargeBenchmarks, "large", false, "Run benchmarks which use 256MB or more of data or a million files")
+	flag.BoolVar(&runCrash, "crash", false, "Run crash consistency tests")
+	flag.DurationVar(&config.StressDuration, "stress-duration", DefaultStressDuration, "Duration of the stress test, zero skips the stress test")
+	flag.IntVar(&config.StressConcurrency, "stress-concurrency", DefaultStressConcurrency, "Number of goroutines in the stress test, zero skips the stress test")
+
+	config.Driver = os.Getenv("DOCKER_GRAPHDRIVER")
+	if options := os.Getenv("DOCKER_GRAPHDRIVER_OPTIONS"); options != "" {
+		config.DriverOptions = strings.Split(options, " ")
+	}
+}
+
+func TestDriver(t *testing.T) {
+	for _, test := range Tests() {
+		f := test.F
+		t.Run(test.Name, func(t *testing.T) {
+			f(t)
+		})
+	}
+}
+
+func TestCrash(t *testing.T) {
+	if !runCrash {
+		t.Skip("crash tests not enabled, use -crash")
+	}
+	for _, test := range CrashTests() {
+		f := test.F
+		t.Run(test.Name, func(t *testing.T) {
+			f(t)
+		})
+	}
+}
+
+func BenchmarkDriver(b *testing.B) {
+	for _, bench := range Benchmarks() {
+		b.Run(bench.Name, bench.F)
+	}
+}
@@ -1,19 +1,24 @@
 package dsdbench
 
 import (
+	"archive/tar"
 	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/docker/docker/layer"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/system"
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/stevvooe/continuity"
+	"github.com/stevvooe/continuity/sysx"
 )
 
 // LayerInit initializes a layer using the provided root
@@ -130,6 +135,63 @@ func CreateDirectory(name string, perm os.FileMode) ApplyFile {
 	}
 }
 
+// CreateDevice returns a file applier to create a character or block
+// device with the provided name, permission and device numbers. The
+// mode must include os.ModeDevice and os.ModeCharDevice for a
+// character device.
+func CreateDevice(name string, mode os.FileMode, major, minor int64) ApplyFile {
+	return func(root string) error {
+		fullPath := filepath.Join(root, name)
+		m := uint32(mode.Perm()) | syscall.S_IFBLK
+		if mode&os.ModeCharDevice != 0 {
+			m = uint32(mode.Perm()) | syscall.S_IFCHR
+		}
+		if err := system.Mknod(fullPath, m, int(system.Mkdev(major, minor))); err != nil {
+			return err
+		}
+		return os.Chmod(fullPath, mode.Perm())
+	}
+}
+
+// CreateFifo returns a file applier to create a named pipe with the
+// provided name and permission
+func CreateFifo(name string, perm os.FileMode) ApplyFile {
+	return func(root string) error {
+		fullPath := filepath.Join(root, name)
+		if err := syscall.Mkfifo(fullPath, uint32(perm.Perm())); err != nil {
+			return err
+		}
+		return os.Chmod(fullPath, perm.Perm())
+	}
+}
+
+// CreateSocket returns a file applier to create a unix socket bound
+// to the provided name, the socket is closed once bound.
+func CreateSocket(name string) ApplyFile {
+	return func(root string) error {
+		dir, err := os.Open(filepath.Join(root, filepath.Dir(name)))
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+
+		return syscall.Bind(fd, &syscall.SockaddrUnix{Name: socketPath(dir, filepath.Base(name))})
+	}
+}
+
+// socketPath returns a path to the name in the directory which fits
+// within the unix socket path limit, the full path to a file in a
+// mounted layer is often too long.
+func socketPath(dir *os.File, name string) string {
+	return fmt.Sprintf("/proc/self/fd/%d/%s", dir.Fd(), name)
+}
+
 // Rename returns a file applier which renames a file
 func Rename(old, new string) ApplyFile {
 	return func(root string) error {
@@ -137,6 +199,13 @@ func Rename(old, new string) ApplyFile {
 	}
 }
 
+// Chmod returns a file applier which changes the mode of a file
+func Chmod(name string, mode os.FileMode) ApplyFile {
+	return func(root string) error {
+		return os.Chmod(filepath.Join(root, name), mode)
+	}
+}
+
 // Chown returns a file applier which changes the ownership of a file
 func Chown(name string, uid, gid int) ApplyFile {
 	return func(root string) error {
@@ -144,6 +213,30 @@ func Chown(name string, uid, gid int) ApplyFile {
 	}
 }
 
+// Link returns a file applier which creates a hard link to an
+// existing file
+func Link(oldname, newname string) ApplyFile {
+	return func(root string) error {
+		return os.Link(filepath.Join(root, oldname), filepath.Join(root, newname))
+	}
+}
+
+// Symlink returns a file applier which creates a symbolic link to
+// the target
+func Symlink(target, name string) ApplyFile {
+	return func(root string) error {
+		return os.Symlink(target, filepath.Join(root, name))
+	}
+}
+
+// SetXattr returns a file applier which sets an extended attribute
+// on a file
+func SetXattr(name, attr string, value []byte) ApplyFile {
+	return func(root string) error {
+		return sysx.LSetxattr(filepath.Join(root, name), attr, value, 0)
+	}
+}
+
 // InitWithFiles returns a layer initializer from the given file appliers
 func InitWithFiles(files ...ApplyFile) LayerInit {
 	return func(root string) error {
@@ -405,3 +498,73 @@ func CheckDirectoryEqual(d1, d2 string) error {
 
 	return nil
 }
+
+// TarHeaders returns the headers from the layer's tar stream keyed by
+// the cleaned path of each entry, such as "/etc/hosts".
+func TarHeaders(l layer.Layer) (map[string]*tar.Header, error) {
+	ts, err := l.TarStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get tar stream")
+	}
+	defer ts.Close()
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(ts)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read tar stream")
+		}
+		headers[tarPath(hdr.Name)] = hdr
+	}
+
+	// Read to the end of the stream to verify the digest and wait
+	// for the layer store to release the layer
+	if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+		return nil, errors.Wrap(err, "failed to read tar stream")
+	}
+
+	return headers, nil
+}
+
+func tarPath(name string) string {
+	return filepath.Clean("/" + strings.TrimSuffix(name, "/"))
+}
+
+// CheckTarLinks checks that each group of paths is stored in the
+// layer's tar stream as a single file with the remaining paths as
+// hard links to it.
+func CheckTarLinks(l layer.Layer, groups ...[]string) error {
+	headers, err := TarHeaders(l)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		var target string
+		for _, p := range group {
+			hdr, ok := headers[p]
+			if !ok {
+				return errors.Errorf("missing %s in tar stream", p)
+			}
+			if hdr.Typeflag != tar.TypeLink {
+				if target != "" {
+					return errors.Errorf("%s is not a link to %s in tar stream", p, target)
+				}
+				target = p
+			}
+		}
+		if target == "" {
+			return errors.Errorf("no file for links %v in tar stream", group)
+		}
+		for _, p := range group {
+			if hdr := headers[p]; hdr.Typeflag == tar.TypeLink && tarPath(hdr.Linkname) != target {
+				return errors.Errorf("%s links to %s in tar stream, expected %s", p, tarPath(hdr.Linkname), target)
+			}
+		}
+	}
+
+	return nil
+}
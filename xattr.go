@@ -0,0 +1,316 @@
+package dsdbench
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"github.com/stevvooe/continuity/sysx"
+)
+
+func init() {
+	registerTests(
+		Test{Name: "XattrUser", F: testXattrUser},
+		Test{Name: "XattrCapability", F: testXattrCapability},
+		Test{Name: "XattrOverlayLeak", F: testXattrOverlayLeak},
+	)
+}
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// tarXattrs returns the extended attributes of a tar entry
+func tarXattrs(hdr *tar.Header) map[string]string {
+	xattrs := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, paxXattrPrefix) {
+			xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = v
+		}
+	}
+	return xattrs
+}
+
+// xattrTar returns an uncompressed tar like TarFromFiles which also
+// includes all extended attributes, the tar created by the archive
+// package only includes file capabilities.
+func xattrTar(files ...ApplyFile) ([]byte, error) {
+	td, err := ioutil.TempDir("", "tar-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(td)
+
+	for _, f := range files {
+		if err := f(td); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := archive.Tar(td, archive.Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := bytes.NewBuffer(nil)
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		p := filepath.Join(td, hdr.Name)
+		attrs, err := sysx.LListxattr(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			value, err := sysx.LGetxattr(p, attr)
+			if err != nil {
+				return nil, err
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxXattrPrefix+attr] = string(value)
+		}
+		hdr.Xattrs = nil
+		hdr.Format = tar.FormatPAX
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// checkTarXattrs checks the extended attributes of the given path in
+// the layer's tar stream, an empty value checks that the attribute is
+// not set. Any overlay attribute in the tar stream is an error.
+func checkTarXattrs(l layer.Layer, path string, xattrs map[string]string) error {
+	headers, err := TarHeaders(l)
+	if err != nil {
+		return err
+	}
+
+	for p, hdr := range headers {
+		for attr := range tarXattrs(hdr) {
+			if strings.HasPrefix(attr, "trusted.overlay.") {
+				return errors.Errorf("driver attribute %s on %s in tar stream", attr, p)
+			}
+		}
+	}
+
+	if path == "" {
+		return nil
+	}
+	hdr, ok := headers[path]
+	if !ok {
+		return errors.Errorf("missing %s in tar stream", path)
+	}
+	actual := tarXattrs(hdr)
+	for attr, value := range xattrs {
+		if actual[attr] != value {
+			return errors.Errorf("unexpected %s on %s in tar stream: %q, expected %q", attr, path, actual[attr], value)
+		}
+	}
+
+	return nil
+}
+
+// testXattrUser registers a layer with user attributes and checks the
+// attributes in the mounted layer, including after copy up of the file
+// and directory in a read-write layer.
+func testXattrUser(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	files := []ApplyFile{
+		CreateDirectory("/etc", 0755),
+		SetXattr("/etc", "user.dir", []byte("etc")),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+		SetXattr("/etc/hosts", "user.mime_type", []byte("text/plain")),
+		NewTestFile("/etc/profile", []byte("PATH=/usr/bin"), 0644),
+	}
+	tar1, err := xattrTar(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l1, err := ls.Register(bytes.NewReader(tar1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Release(l1)
+
+	if err := CheckLayer(ls, l1.ChainID(), InitWithFiles(files...)); err != nil {
+		t.Fatalf("Layer check failure: %+v", err)
+	}
+	if err := checkTarXattrs(l1, "/etc/hosts", map[string]string{"user.mime_type": "text/plain"}); err != nil {
+		t.Fatalf("Tar stream check failure: %+v", err)
+	}
+
+	// Check copy up of the lower file and directory in the mount
+	// since only file capabilities are committed.
+	updates := []ApplyFile{
+		SetXattr("/etc/profile", "user.mime_type", []byte("text/x-shellscript")),
+		SetXattr("/etc", "user.updated", []byte("1")),
+		NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.2"), 0644),
+	}
+	td, err := ioutil.TempDir("", "check-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err := InitWithFiles(append(files, updates...)...)(td); err != nil {
+		t.Fatal(err)
+	}
+
+	_, p, release := mountRWLayer(t, ls, l1.ChainID())
+	defer release()
+
+	if err := InitWithFiles(updates...)(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckDirectoryEqual(p, td); err != nil {
+		t.Fatalf("Copy up check failure: %+v", err)
+	}
+}
+
+// fileCapability returns a version 2 file capability with the given
+// capabilities permitted and effective
+func fileCapability(caps ...uint) []byte {
+	const (
+		vfsCapRevision2   = 0x02000000
+		vfsCapFlagsEffect = 0x000001
+	)
+
+	var permitted [2]uint32
+	for _, c := range caps {
+		permitted[c/32] |= 1 << (c % 32)
+	}
+
+	b := make([]byte, 20)
+	binary.LittleEndian.PutUint32(b[0:], vfsCapRevision2|vfsCapFlagsEffect)
+	binary.LittleEndian.PutUint32(b[4:], permitted[0])
+	binary.LittleEndian.PutUint32(b[12:], permitted[1])
+	return b
+}
+
+// testXattrCapability checks that file capabilities, such as on ping,
+// are kept in committed layers and when a file is copied up.
+func testXattrCapability(t T) {
+	requireRoot(t)
+
+	const capNetRaw = 13
+	capability := fileCapability(capNetRaw)
+
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	l1Init := InitWithFiles(
+		CreateDirectory("/bin", 0755),
+		NewTestFile("/bin/ping", []byte("#!/bin/ping"), 0755),
+		SetXattr("/bin/ping", "security.capability", capability),
+		CreateDirectory("/usr/bin", 0755),
+	)
+	l2Init := InitWithFiles(
+		Rename("/bin/ping", "/usr/bin/ping"),
+	)
+
+	l1, err := CreateLayer(ls, "", l1Init)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l1)
+
+	if err := CheckLayer(ls, l1.ChainID(), l1Init); err != nil {
+		t.Fatalf("Layer check failure: %+v", err)
+	}
+	if err := checkTarXattrs(l1, "/bin/ping", map[string]string{"security.capability": string(capability)}); err != nil {
+		t.Fatalf("Tar stream check failure: %+v", err)
+	}
+
+	l2, err := CreateLayer(ls, l1.ChainID(), l2Init)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %+v", err)
+	}
+	defer ls.Release(l2)
+
+	if err := CheckLayer(ls, l2.ChainID(), l1Init, l2Init); err != nil {
+		t.Fatalf("Layer check failure after copy up: %+v", err)
+	}
+	if err := checkTarXattrs(l2, "/usr/bin/ping", map[string]string{"security.capability": string(capability)}); err != nil {
+		t.Fatalf("Tar stream check failure after copy up: %+v", err)
+	}
+}
+
+// testXattrOverlayLeak checks that attributes used internally by
+// drivers, such as the overlay opaque directory attribute, are not
+// visible in the mount or tar stream.
+func testXattrOverlayLeak(t T) {
+	ls, err := getLayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, ls)
+
+	layers := []LayerInit{
+		InitWithFiles(
+			CreateDirectory("/etc/conf.d", 0755),
+			NewTestFile("/etc/conf.d/a", []byte("a"), 0644),
+			NewTestFile("/etc/hosts", []byte("mydomain 10.0.0.1"), 0644),
+		),
+		InitWithFiles(
+			RemoveFile("/etc/conf.d"),
+			CreateDirectory("/etc/conf.d", 0755),
+			NewTestFile("/etc/conf.d/b", []byte("b"), 0644),
+			RemoveFile("/etc/hosts"),
+		),
+		InitWithFiles(
+			NewTestFile("/etc/conf.d/c", []byte("c"), 0644),
+		),
+	}
+
+	var parent layer.ChainID
+	for i, li := range layers {
+		l, err := CreateLayer(ls, parent, li)
+		if err != nil {
+			t.Fatalf("Failed to create layer %d: %+v", i+1, err)
+		}
+		defer ls.Release(l)
+		parent = l.ChainID()
+
+		if err := CheckLayer(ls, l.ChainID(), layers[:i+1]...); err != nil {
+			t.Fatalf("Layer %d check failure: %+v", i+1, err)
+		}
+		if err := checkTarXattrs(l, "", nil); err != nil {
+			t.Fatalf("Layer %d tar stream check failure: %+v", i+1, err)
+		}
+	}
+}